@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Action func(d *Device) error
+
+var SceneNames = []string{"red", "white", "off", "green", "blue"}
+
+// ActionConfig is a configured action: either a service call or, if TTS is set, an announcement
+type ActionConfig struct {
+	ServiceCall
+	TTS *TTSConfig `json:"tts"`
+}
+
+func (c ActionConfig) Action() Action {
+	if c.TTS != nil {
+		return c.TTS.Action()
+	}
+	return c.ServiceCall.Action()
+}
+
+// ServiceCall is an action calling a Home Assistant service, e.g. {"service": "light.turn_on", "data": {"entity_id": "light.desk"}}
+type ServiceCall struct {
+	Service string                 `json:"service"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+func (call ServiceCall) Action() Action {
+	return func(d *Device) error {
+		return d.HA.CallService(call.Service, call.Data)
+	}
+}
+
+// CallService calls a service given as "domain.service"
+func (ha *HomeAssistant) CallService(service string, data interface{}) error {
+	domain, name, ok := strings.Cut(service, ".")
+	if !ok {
+		return fmt.Errorf("invalid service %q, expected domain.service", service)
+	}
+	_, err := ha.CallHomeAssistant("services/"+domain+"/"+name, "POST", getJson(data))
+	return err
+}
+
+func (d *Device) BuiltinActions() map[string]Action {
+	actions := map[string]Action{
+		"rickroll": func(d *Device) error {
+			return d.LaunchRickRoll()
+		},
+		"show_scenes": func(d *Device) error {
+			d.ShowScenes()
+			return nil
+		},
+		"stop_animation": func(d *Device) error {
+			d.StopAnimation()
+			return nil
+		},
+		"command_mode": func(d *Device) error {
+			d.ToggleCommandMode()
+			return nil
+		},
+		"learn_start": func(d *Device) error {
+			return d.StartLearning()
+		},
+		"learn_stop": func(d *Device) error {
+			d.StopLearning()
+			return nil
+		},
+	}
+	for i, name := range SceneNames {
+		scene := i
+		actions["scene_"+name] = func(d *Device) error {
+			return d.SendScene(scene)
+		}
+	}
+	return actions
+}
+
+func (d *Device) RunAction(name string) error {
+	action, ok := d.Actions[name]
+	if !ok {
+		return fmt.Errorf("unknown action %q", name)
+	}
+	return action(d)
+}
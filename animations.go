@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/midi/smf"
+)
+
+// Animation draws on the device until it is done or stop is closed
+type Animation func(d *Device, stop <-chan struct{})
+
+var Animations = map[string]Animation{
+	"rainbow":  rainbowAnimation,
+	"rickroll": rickRollAnimation,
+}
+
+func (d *Device) StartAnimation(name string) error {
+	animation, ok := Animations[name]
+	if !ok {
+		return fmt.Errorf("unknown animation %q", name)
+	}
+	d.mu.Lock()
+	if d.PlayingAnimation {
+		d.mu.Unlock()
+		return fmt.Errorf("animation %q is already playing", d.animationName)
+	}
+	stop := make(chan struct{})
+	d.PlayingAnimation = true
+	d.animationName = name
+	d.stopAnimation = stop
+	d.mu.Unlock()
+	go func() {
+		animation(d, stop)
+		d.mu.Lock()
+		d.PlayingAnimation = false
+		d.animationName = ""
+		d.stopAnimation = nil
+		d.mu.Unlock()
+		d.RestoreDefaults()
+	}()
+	return nil
+}
+
+func (d *Device) StopAnimation() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopAnimation != nil {
+		close(d.stopAnimation)
+		d.stopAnimation = nil
+	}
+}
+
+// CurrentAnimation returns the name of the playing animation or an empty string
+func (d *Device) CurrentAnimation() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.animationName
+}
+
+// sleepOrStop returns false if stop was closed before d passed
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// RAINBOW_BEATS is how many beats of the clock a color takes to spread over the keys
+const RAINBOW_BEATS = 2
+
+func rainbowAnimation(d *Device, stop <-chan struct{}) {
+	//ToDO: other animations? reacting to music?
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	previousColor := Color{1, 2}
+	currentColor := Color{1, 2}
+	topRow, strip := Regions["top_row"], Regions["strip"]
+	i := -1
+	for {
+		var tick uint64
+		select {
+		case <-stop:
+			return
+		case tick = <-ticks:
+		}
+		if !d.Tempo.Running() {
+			continue
+		}
+		// a color starts every RAINBOW_BEATS beats, so the rainbow follows the tempo and the beats of the DAW
+		next := int(tick%(RAINBOW_BEATS*PPQN)) * (NB_KEYS/2 + 1) / (RAINBOW_BEATS * PPQN)
+		if next == i {
+			continue
+		}
+		if next < i {
+			previousColor = currentColor
+			currentColor.Color++
+			if currentColor.Color == 16 {
+				currentColor.Color = 1
+				//currentColor.Brightness++
+			}
+		}
+		i = next
+		d.mu.Lock()
+		d.CurrentKeysBuffer[30+i] = GetColor(currentColor)
+		d.CurrentKeysBuffer[30-i] = GetColor(currentColor)
+		if i < len(strip) {
+			d.CurrentButtonsBuffer[strip[len(strip)-1-i]] = GetColor(previousColor)
+		}
+		if i < 8 {
+			// from the middle of the top row outwards
+			d.CurrentButtonsBuffer[topRow[3-i/2]] = GetColor(currentColor)
+			d.CurrentButtonsBuffer[topRow[4+i/2]] = GetColor(currentColor)
+		}
+		if i == 13 {
+			d.CurrentButtonsBuffer[S_BUTTON] = GetColor(currentColor)
+		}
+		if i == 14 {
+			d.CurrentButtonsBuffer[M_BUTTON] = GetColor(currentColor)
+		}
+		d.mu.Unlock()
+		d.WriteBuffer()
+	}
+}
+
+// the tempo the notes of the rickroll are played at, with RICKROLL_RESOLUTION
+const (
+	RICKROLL_BPM        = 113
+	RICKROLL_RESOLUTION = 404
+)
+
+func rickRollAnimation(d *Device, stop <-chan struct{}) {
+	d.LightsOff()
+	d.SetCurrentKeysAsDefault()
+	done := make(chan struct{})
+	defer close(done)
+	// the sequencer, the metronome and the MIDI clock go back to their tempo afterwards
+	bpm := d.Tempo.BPM()
+	defer d.Tempo.SetBPM(bpm)
+	d.Tempo.SetBPM(RICKROLL_BPM)
+	d.Tempo.Restart()
+	play := ledOf("PlayPressed")
+	go func() {
+		ticks := d.Tempo.Subscribe()
+		defer d.Tempo.Unsubscribe(ticks)
+		for {
+			var tick uint64
+			select {
+			case <-stop:
+				return
+			case <-done:
+				return
+			case tick = <-ticks:
+			}
+			if !d.Tempo.Running() {
+				continue
+			}
+			switch tick % PPQN {
+			case 0:
+				d.WriteButtonColor(play, GetColor(Color{WHITE, 2}))
+			case PPQN / 2:
+				d.WriteButtonColor(play, GetColor(Color{BLACK, 2}))
+			}
+		}
+	}()
+	if err := d.PlayMIDIFile("Never-Gonna-Give-You-Up-3.mid", RICKROLL_RESOLUTION, stop); err != nil {
+		animLog.Error("playing the MIDI file", "err", err)
+	}
+}
+
+// PlayMIDIFile lights the notes of a MIDI file as they are played on the clock, until stop is closed.
+// It waits while the clock isn't running. A resolution of 0 takes the one of the file.
+func (d *Device) PlayMIDIFile(file string, resolution smf.MetricTicks, stop <-chan struct{}) error {
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	playing := true
+	// the clock ticks since the start
+	var elapsed uint64
+	// wait waits for the clock to reach the position of a message, and returns false if stop was closed
+	wait := func(p *reader.Position) bool {
+		if !playing {
+			return false
+		}
+		if resolution == 0 {
+			resolution = PPQN
+		}
+		for elapsed < p.AbsoluteTicks*PPQN/uint64(resolution) {
+			select {
+			case <-stop:
+				playing = false
+				return false
+			case <-ticks:
+				if d.Tempo.Running() {
+					elapsed++
+				}
+			}
+		}
+		return true
+	}
+	rd := reader.New(
+		reader.NoLogger(),
+		reader.SMFHeader(func(h smf.Header) {
+			if ticks, ok := h.TimeFormat.(smf.MetricTicks); ok && resolution == 0 {
+				resolution = ticks
+			}
+		}),
+		reader.NoteOn(func(p *reader.Position, channel, key, vel uint8) {
+			if !wait(p) {
+				return
+			}
+			animLog.Debug("NoteOn", "track", p.Track, "pos", p.AbsoluteTicks, "channel", channel, "key", key)
+			d.NoteOnCallback(key, channel, vel)
+		}),
+		reader.NoteOff(func(p *reader.Position, channel, key, vel uint8) {
+			if !wait(p) {
+				return
+			}
+			animLog.Debug("NoteOff", "track", p.Track, "pos", p.AbsoluteTicks, "channel", channel, "key", key)
+			d.NoteOffCallback(key, channel)
+		}),
+	)
+	return reader.ReadSMFFile(rd, file)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeAPI serves the local control API:
+//
+//	GET    /state                current DeviceState
+//	POST   /keys/{key}           {"color": 1, "brightness": 2}
+//	POST   /buttons/{button}     {"color": 1, "brightness": 2}
+//	POST   /fill                 {"color": 1, "brightness": 2}
+//	GET    /animations           name of the playing animation
+//	POST   /animations/{name}    start an animation
+//	DELETE /animations           stop the current animation
+//	POST   /actions/{name}       run an action
+//	GET    /failures             number of failures of each action
+//	GET    /events               Server-Sent Events stream of InputEvent
+//	GET    /metrics              Prometheus metrics
+func (d *Device) ServeAPI(addr string) error {
+	return http.ListenAndServe(addr, d.APIHandler())
+}
+
+// APIHandler routes the requests of the API described at ServeAPI
+func (d *Device) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", d.handleState)
+	mux.HandleFunc("/keys/", d.handleKey)
+	mux.HandleFunc("/buttons/", d.handleButton)
+	mux.HandleFunc("/fill", d.handleFill)
+	mux.HandleFunc("/animations", d.handleAnimations)
+	mux.HandleFunc("/animations/", d.handleAnimations)
+	mux.HandleFunc("/actions/", d.handleAction)
+	mux.HandleFunc("/failures", d.handleFailures)
+	mux.HandleFunc("/events", d.handleEvents)
+	mux.HandleFunc("/metrics", handleMetrics)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func readColor(r *http.Request) (Color, error) {
+	var c Color
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return c, err
+	}
+	return c, c.Check()
+}
+
+func (d *Device) handleState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, d.GetState())
+}
+
+func (d *Device) handleKey(w http.ResponseWriter, r *http.Request) {
+	d.handleIndexedColor(w, r, "/keys/", NB_KEYS, d.WriteKeyColor)
+}
+
+func (d *Device) handleButton(w http.ResponseWriter, r *http.Request) {
+	d.handleIndexedColor(w, r, "/buttons/", NB_BUTTONS, d.WriteButtonColor)
+}
+
+func (d *Device) handleIndexedColor(w http.ResponseWriter, r *http.Request, prefix string, n int, write func(int, byte)) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil || i < 0 || i >= n {
+		writeError(w, http.StatusNotFound, fmt.Errorf("index must be between 0 and %d", n-1))
+		return
+	}
+	c, err := readColor(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	write(i, GetColor(c))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Device) handleFill(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	c, err := readColor(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.WriteAll(c)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Device) handleAnimations(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/animations"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, map[string]string{"playing": d.CurrentAnimation()})
+	case r.Method == http.MethodDelete:
+		d.StopAnimation()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && name != "":
+		if _, ok := Animations[name]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown animation %q", name))
+			return
+		}
+		if err := d.StartAnimation(name); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (d *Device) handleAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/actions/")
+	if _, ok := d.Actions[name]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", name))
+		return
+	}
+	if err := d.RunActionFrom("", name); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFailures returns how many times each action failed
+func (d *Device) handleFailures(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, d.Failures())
+}
+
+func (d *Device) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events := d.Events.Subscribe()
+	defer d.Events.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			fmt.Fprintf(w, "data: %s\n\n", getJson(e))
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIColors(t *testing.T) {
+	d := newTestDevice()
+	srv := httptest.NewServer(d.APIHandler())
+	defer srv.Close()
+	for _, c := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/keys/3", `{"color": 1, "brightness": 2}`, http.StatusNoContent},
+		{"/buttons/0", `{"color": 17, "brightness": 3}`, http.StatusNoContent},
+		{"/keys/61", `{"color": 1, "brightness": 2}`, http.StatusNotFound},
+		{"/keys/3", `{"color": 18, "brightness": 0}`, http.StatusBadRequest},
+		{"/fill", `{"color": 1, "brightness": 4}`, http.StatusBadRequest},
+		{"/fill", `not json`, http.StatusBadRequest},
+	} {
+		resp, err := http.Post(srv.URL+c.path, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("POST %s %s: got %d, want %d", c.path, c.body, resp.StatusCode, c.status)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.CurrentKeysBuffer[3] != GetColor(Color{RED, 2}) || d.CurrentButtonsBuffer[0] != GetColor(Color{WHITE, 3}) {
+		t.Error("colors not set")
+	}
+}
+
+func TestAPIState(t *testing.T) {
+	d := newTestDevice()
+	d.ParseDeviceState(report(map[int]byte{2: 128}))
+	srv := httptest.NewServer(d.APIHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var state DeviceState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.ShiftPressed {
+		t.Error("Shift not pressed in", state)
+	}
+
+	resp, err = http.Post(srv.URL+"/state", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodGet {
+		t.Errorf("POST /state: got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIAnimations(t *testing.T) {
+	d := newTestDevice()
+	srv := httptest.NewServer(d.APIHandler())
+	defer srv.Close()
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := do(http.MethodPost, "/animations/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown animation: got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/animations/rainbow"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("rainbow: got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/animations/rainbow"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second rainbow: got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/animations"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("stop: got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIActionFailure(t *testing.T) {
+	d := newTestDevice()
+	srv := httptest.NewServer(d.APIHandler())
+	defer srv.Close()
+	// HA can't be reached
+	resp, err := http.Post(srv.URL+"/actions/scene_red", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	resp, err = http.Get(srv.URL + "/failures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var failures map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if failures["scene_red"] != 1 {
+		t.Errorf("failures %v", failures)
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	d := newTestDevice()
+	srv := httptest.NewServer(d.APIHandler())
+	defer srv.Close()
+	// the stream is subscribed once its headers are sent
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("content type", resp.Header.Get("Content-Type"))
+	}
+	d.ParseDeviceState(report(map[int]byte{2: 128}))
+	lines := bufio.NewScanner(resp.Body)
+	within(t, 5*time.Second, func() {
+		for lines.Scan() {
+			data, ok := strings.CutPrefix(lines.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var e InputEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Error(data, err)
+				return
+			}
+			if e.Control == "ShiftPressed" && e.Kind == "button" && e.Value == true {
+				return
+			}
+		}
+		t.Error("stream ended:", lines.Err())
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mihonarium/go-hid"
+)
+
+// A capture is a text file with a line per input report: the microseconds since the capture started and the report in hex.
+// Lines starting with # are comments.
+
+// CaptureCommand records the raw input reports of the keyboard to a file until interrupted
+func CaptureCommand(args []string) error {
+	flags := commandFlags("capture")
+	output := flags.String("o", "capture.txt", "file to write the reports to")
+	duration := flags.Duration("duration", 0, "stop after this long; 0 records until interrupted")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: capture [flags]")
+	}
+
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	defer dHid.Close()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := time.Now()
+	fmt.Fprintf(f, "# capture started %s\n", start.Format(time.RFC3339))
+	fmt.Println("Recording to", *output)
+	var n int
+	for *duration == 0 || time.Since(start) < *duration {
+		buffer := make([]byte, 42)
+		read, err := dHid.Read(buffer)
+		if err != nil {
+			return err
+		}
+		if read == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(f, "%d %s\n", time.Since(start).Microseconds(), hex.EncodeToString(buffer[:read]))
+		if err != nil {
+			return err
+		}
+		n++
+		fmt.Printf("\r%d reports", n)
+	}
+	fmt.Println()
+	return nil
+}
+
+type capturedReport struct {
+	at     time.Duration
+	report []byte
+}
+
+func ReadCapture(path string) ([]capturedReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reports []capturedReport
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a time and a report", path, line)
+		}
+		us, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		report, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		reports = append(reports, capturedReport{time.Duration(us) * time.Microsecond, report})
+	}
+	return reports, scanner.Err()
+}
+
+// ReplayCommand feeds a capture to ParseDeviceState, so the bindings and actions run as if the keyboard sent it
+func ReplayCommand(args []string) error {
+	flags := commandFlags("replay")
+	speed := flags.Float64("speed", 1, "playback speed; 0 replays without waiting")
+	lights := flags.Bool("lights", false, "show the LEDs on the keyboard, if it is connected")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [flags] capture.txt")
+	}
+	reports, err := ReadCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var dHid *hid.Device
+	if *lights {
+		dHid, err = OpenKeyboard()
+		if err != nil {
+			return err
+		}
+		defer dHid.Close()
+	}
+	// a replay doesn't change the state the keyboard is left in
+	config.StateFile = ""
+	d, err := setupDevice(config, dHid)
+	if err != nil {
+		return err
+	}
+	d.LightsOff()
+
+	start := time.Now()
+	for _, r := range reports {
+		if *speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(r.at) / *speed))))
+		}
+		// ParseDeviceState reads up to byte 37 of a full report
+		buffer := make([]byte, 42)
+		copy(buffer, r.report)
+		d.ParseDeviceState(buffer)
+	}
+	// the actions run in the background
+	d.WaitActions()
+	d.FlushLEDs()
+	return nil
+}
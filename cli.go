@@ -0,0 +1,351 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Mihonarium/go-hid"
+	"gitlab.com/gomidi/rtmididrv"
+)
+
+// set from the command line flags, given before or after the command
+var (
+	configPath   = CONFIG_FILE
+	serialNumber = SERIAL_NUMBER
+	verbose      bool
+	logJSON      bool
+)
+
+// addGlobalFlags defines the flags setting the variables above
+func addGlobalFlags(flags *flag.FlagSet) {
+	flags.StringVar(&configPath, "config", configPath, "config file")
+	flags.StringVar(&serialNumber, "serial", serialNumber, "serial number of the keyboard; empty opens the first one")
+	flags.BoolVar(&verbose, "v", verbose, "log everything, at the debug level")
+	flags.BoolVar(&logJSON, "log-json", logJSON, "log as JSON")
+}
+
+// commandFlags returns the flag set of a command, which also accepts the flags given before the command,
+// e.g. "run -config other.json"
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	addGlobalFlags(flags)
+	return flags
+}
+
+type Command struct {
+	Run         func(args []string) error
+	Description string
+}
+
+var Commands = map[string]Command{
+	"run":          {RunCommand, "run the keyboard with the config (default)"},
+	"list-devices": {ListDevicesCommand, "list the keyboards and the MIDI ports"},
+	"lights":       {LightsCommand, "set the colors of the LEDs and exit"},
+	"play":         {PlayCommand, "light the keys with the notes of a MIDI file"},
+	"monitor":      {MonitorCommand, "print the controls as they change"},
+	"check-config": {CheckConfigCommand, "check the config and exit"},
+	"capture":      {CaptureCommand, "record the raw input reports of the keyboard"},
+	"replay":       {ReplayCommand, "run the bindings and actions on a capture"},
+	"probe":        {ProbeCommand, "find out which LED each report index lights"},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-14s %s\n", name, Commands[name].Description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// loadConfig loads the config given on the command line, sets up logging with it and applies the LED layout
+func loadConfig() (*Config, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config.Log.JSON = config.Log.JSON || logJSON
+	if err := SetupLogging(config.Log, verbose); err != nil {
+		return nil, err
+	}
+	profile, err := LoadLayoutProfile(config.Layout)
+	if err != nil {
+		return nil, fmt.Errorf("loading the layout: %w", err)
+	}
+	if profile != nil {
+		profile.Apply()
+	}
+	return config, nil
+}
+
+// OpenKeyboard opens the keyboard with the serial number given on the command line, or the first one
+func OpenKeyboard() (*hid.Device, error) {
+	if err := hid.Init(); err != nil {
+		return nil, err
+	}
+	var dHid *hid.Device
+	var err error
+	if serialNumber == "" {
+		dHid, err = hid.OpenFirst(VENDOR_ID, PRODUCT_ID)
+	} else {
+		dHid, err = hid.Open(VENDOR_ID, PRODUCT_ID, serialNumber)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening the keyboard: %w", err)
+	}
+	dHid.Write([]byte{0xa0})
+	return dHid, nil
+}
+
+func ListDevicesCommand(args []string) error {
+	flags := commandFlags("list-devices")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: list-devices [flags]")
+	}
+	if err := hid.Init(); err != nil {
+		return err
+	}
+	fmt.Println("Keyboards:")
+	err := hid.Enumerate(VENDOR_ID, PRODUCT_ID, func(info *hid.DeviceInfo) error {
+		fmt.Printf("  %s %s (serial %s, interface %d)\n", info.MfrStr, info.ProductStr, info.SerialNbr, info.InterfaceNbr)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	drv, err := rtmididrv.New()
+	if err != nil {
+		return err
+	}
+	defer drv.Close()
+	ins, err := drv.Ins()
+	if err != nil {
+		return err
+	}
+	fmt.Println("MIDI inputs:")
+	for _, in := range ins {
+		fmt.Printf("  %d: %s\n", in.Number(), in.String())
+	}
+	outs, err := drv.Outs()
+	if err != nil {
+		return err
+	}
+	fmt.Println("MIDI outputs:")
+	for _, out := range outs {
+		fmt.Printf("  %d: %s\n", out.Number(), out.String())
+	}
+	return nil
+}
+
+// ColorNames are the names of the colors accepted on the command line
+var ColorNames = map[string]uint8{
+	"black": BLACK, "red": RED, "orange0": ORANGE0, "orange": ORANGE, "yellow": YELLOW, "yellow2": YELLOW2,
+	"lightgreen": LIGHTGREEN, "green": GREEN, "sea": SEA, "lightblue": LIGHTBLUE, "blue": BLUE, "darkblue": DARKBLUE,
+	"purple": PURPLE, "purple2": PURPLE2, "pink": PINK, "pink2": PINK2, "pink3": PINK3, "white": WHITE,
+}
+
+// parseColor reads a color given as a name or a number, and a brightness
+func parseColor(color, brightness string) (Color, error) {
+	c, ok := ColorNames[strings.ToLower(color)]
+	if !ok {
+		n, err := strconv.ParseUint(color, 10, 8)
+		if err != nil {
+			return Color{}, fmt.Errorf("unknown color %q", color)
+		}
+		c = uint8(n)
+	}
+	b, err := strconv.ParseUint(brightness, 10, 8)
+	if err != nil || b > 3 {
+		return Color{}, fmt.Errorf("brightness must be between 0 and 3")
+	}
+	parsed := Color{c, uint8(b)}
+	return parsed, parsed.Check()
+}
+
+func LightsCommand(args []string) error {
+	flags := commandFlags("lights")
+	only := flags.String("only", "", "\"keys\" or \"buttons\"; both by default")
+	key := flags.Int("key", -1, "set only this key")
+	control := flags.String("control", "", "set only the LED of this control or region, e.g. PlayPressed or strip")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lights [flags] color [brightness]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: lights [flags] color [brightness]")
+	}
+	brightness := "2"
+	if flags.NArg() == 2 {
+		brightness = flags.Arg(1)
+	}
+	c, err := parseColor(flags.Arg(0), brightness)
+	if err != nil {
+		return err
+	}
+	// for the logging and the layout
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	defer dHid.Close()
+	// without the LED writer, the buffers are written below
+	d := NewDevice(dHid, &HomeAssistant{})
+	switch {
+	case *key >= 0:
+		d.WriteKeyColor(*key, GetColor(c))
+	case *control != "":
+		if _, ok := Regions[*control]; ok {
+			err = d.LightRegion(*control, c)
+		} else {
+			err = d.LightControl(*control, c, false)
+		}
+	case *only == "keys":
+		d.WriteAllKeys(c)
+	case *only == "buttons":
+		d.FillColorfulButtons(c)
+	default:
+		d.WriteAll(c)
+	}
+	if err != nil {
+		return err
+	}
+	d.WriteToDevice(0x81, d.CurrentKeysBuffer)
+	d.WriteToDevice(0x80, d.CurrentButtonsBuffer)
+	return nil
+}
+
+func PlayCommand(args []string) error {
+	flags := commandFlags("play")
+	bpm := flags.Uint("bpm", DEFAULT_BPM, "tempo")
+	loop := flags.Bool("loop", false, "play until interrupted")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: play [flags] file.mid")
+	}
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	defer dHid.Close()
+	d := NewDevice(dHid, &HomeAssistant{})
+	d.StartLEDWriter()
+	d.LightsOff()
+	d.Tempo.SetBPM(float64(*bpm))
+	d.Tempo.Start()
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	for {
+		if err := d.PlayMIDIFile(flags.Arg(0), 0, stop); err != nil {
+			return err
+		}
+		interrupted := false
+		select {
+		case <-stop:
+			interrupted = true
+		default:
+		}
+		if !*loop || interrupted {
+			break
+		}
+	}
+	d.LightsOff()
+	d.FlushLEDs()
+	return nil
+}
+
+// MonitorCommand prints the controls of the keyboard as they change, without running anything
+func MonitorCommand(args []string) error {
+	flags := commandFlags("monitor")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: monitor [flags]")
+	}
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	defer dHid.Close()
+	d := NewDevice(dHid, &HomeAssistant{})
+	for {
+		buffer := make([]byte, 42)
+		n, err := dHid.Read(buffer)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		old, state := d.DecodeDeviceState(buffer)
+		d.ReflectChanges(reflect.ValueOf(old), reflect.ValueOf(state), func(field string, i int, oldValue, newValue interface{}) {
+			fmt.Printf("%-24s %v -> %v\n", controlID(field, i), oldValue, newValue)
+		})
+	}
+}
+
+// CheckConfigCommand loads the config and checks what refers to actions, controls, colors and files, without starting anything
+func CheckConfigCommand(args []string) error {
+	flags := commandFlags("check-config")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: check-config [flags]")
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	d := NewDevice(nil, &config.HomeAssistant)
+	var problems []string
+	if err := d.Configure(config); err != nil {
+		problems = strings.Split(err.Error(), "\n")
+	}
+	if config.Learn.File != "" {
+		steps, err := LoadLearnSteps(config.Learn)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("learn: %v", err))
+		} else {
+			d.mu.Lock()
+			outside, left := d.learnNotesOffKeyboard(steps)
+			d.mu.Unlock()
+			if !left {
+				problems = append(problems, fmt.Sprintf("learn: no note of %s is on the keyboard", config.Learn.File))
+			} else if len(outside) > 0 {
+				fmt.Printf("learn: %d notes of %s are outside of the keyboard unless it is transposed, from %d to %d\n",
+					len(outside), config.Learn.File, outside[0], outside[len(outside)-1])
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s:\n  %s", configPath, strings.Join(problems, "\n  "))
+	}
+	fmt.Println(configPath, "is fine")
+	return nil
+}
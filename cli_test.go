@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkConfig runs check-config on a config file with the given content
+func checkConfig(t *testing.T, content string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configPath = CONFIG_FILE }()
+	return CheckConfigCommand([]string{"-config", path})
+}
+
+func TestCheckConfig(t *testing.T) {
+	if err := checkConfig(t, `{}`); err != nil {
+		t.Error("the default config:", err)
+	}
+	if err := checkConfig(t, `{"feedback": {"ShiftPressed": {"mode": "toggle"}, "ARPPressed": {"mode": "momentary"}}}`); err != nil {
+		t.Error("feedback on panel buttons:", err)
+	}
+	for problem, config := range map[string]string{
+		"unknown action":       `{"bindings": {"PlayPressed": "no_such_action"}}`,
+		"misspelled control":   `{"bindings": {"PlayPresed": "scene_red"}}`,
+		"knob 9":               `{"continuous": {"BottomRowPitch9": {"entity": "light.test", "attribute": "brightness"}}}`,
+		"DAW mode":             `{"daw": {"mode": "cubase"}}`,
+		"color":                `{"binding_lights": {"PlayPressed": {"color": 70, "brightness": 1}}}`,
+		"metronome LED":        `{"tempo": {"metronome_led": 1000}}`,
+		"note out of range":    `{"note_bindings": [{"note": 200, "action": "scene_red"}]}`,
+		"note range reversed":  `{"note_bindings": [{"note": 60, "note_high": 50, "action": "scene_red"}]}`,
+		"missing learn file":   `{"learn": {"file": "no_such_file.mid"}}`,
+		"two problems at once": `{"bindings": {"PlayPressed": "no_such_action"}, "daw": {"mode": "cubase"}}`,
+	} {
+		err := checkConfig(t, config)
+		if err == nil {
+			t.Errorf("%s: not found in %s", problem, config)
+			continue
+		}
+		if problem == "two problems at once" && strings.Count(err.Error(), "\n") < 2 {
+			t.Errorf("%s: only one reported: %v", problem, err)
+		}
+	}
+	if err := checkConfig(t, `{"bindings": `); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+	if err := CheckConfigCommand([]string{"config.json"}); err == nil {
+		t.Error("argument accepted")
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for _, c := range []struct {
+		color, brightness string
+		want              Color
+		ok                bool
+	}{
+		{"red", "2", Color{RED, 2}, true},
+		{"Blue", "0", Color{BLUE, 0}, true},
+		{"7", "3", Color{GREEN, 3}, true},
+		{"70", "1", Color{}, false},
+		{"mauve", "1", Color{}, false},
+		{"red", "4", Color{}, false},
+	} {
+		got, err := parseColor(c.color, c.brightness)
+		if (err == nil) != c.ok || c.ok && got != c.want {
+			t.Errorf("parseColor(%q, %q) = %v, %v", c.color, c.brightness, got, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "fmt"
+
+// NoteBinding runs an action when a note in [Note, NoteHigh] is played in command mode with a velocity in [MinVelocity, MaxVelocity]
+type NoteBinding struct {
+	Note        int    `json:"note"`
+	NoteHigh    int    `json:"note_high"` // last note of the range; 0 means just Note
+	MinVelocity uint8  `json:"min_velocity"`
+	MaxVelocity uint8  `json:"max_velocity"` // 0 means 127
+	Action      string `json:"action"`
+}
+
+func (b NoteBinding) matches(note, velocity uint8) bool {
+	high := b.NoteHigh
+	if high == 0 {
+		high = b.Note
+	}
+	maxVelocity := b.MaxVelocity
+	if maxVelocity == 0 {
+		maxVelocity = 127
+	}
+	return int(note) >= b.Note && int(note) <= high && velocity >= b.MinVelocity && velocity <= maxVelocity
+}
+
+// SetNoteBindings sets the note bindings, once they are checked against the notes and the actions
+func (d *Device) SetNoteBindings(bindings []NoteBinding) error {
+	for _, b := range bindings {
+		if b.Note < 0 || b.Note > 127 || b.NoteHigh < 0 || b.NoteHigh > 127 {
+			return fmt.Errorf("note binding of %d: notes must be between 0 and 127", b.Note)
+		}
+		if b.NoteHigh != 0 && b.NoteHigh < b.Note {
+			return fmt.Errorf("note binding of %d: note_high is below note", b.Note)
+		}
+		if b.MinVelocity > 127 || b.MaxVelocity > 127 || (b.MaxVelocity != 0 && b.MinVelocity > b.MaxVelocity) {
+			return fmt.Errorf("note binding of %d: velocities must be between 0 and 127, min_velocity first", b.Note)
+		}
+		if _, ok := d.Actions[b.Action]; !ok {
+			return fmt.Errorf("note binding of %d: unknown action %q", b.Note, b.Action)
+		}
+	}
+	d.NoteBindings = bindings
+	return nil
+}
+
+var CommandModeColor = Color{ORANGE, 1}
+
+// ToggleCommandMode turns the piano keys into action buttons, lighting the bound ones, or back
+func (d *Device) ToggleCommandMode() {
+	d.mu.Lock()
+	d.commandMode = !d.commandMode
+	if d.commandMode {
+		for _, b := range d.NoteBindings {
+			high := b.NoteHigh
+			if high == 0 {
+				high = b.Note
+			}
+			for note := b.Note; note <= high; note++ {
+				if key := d.noteKey(uint8(note)); key >= 0 && key < NB_KEYS {
+					d.CurrentKeysBuffer[key] = GetColor(CommandModeColor)
+				}
+			}
+		}
+	} else {
+		d.restoreKeysLocked()
+	}
+	inputLog.Info("command mode", "on", d.commandMode)
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+}
+
+// commandNoteOn runs the action bound to a played note and reports whether command mode is on
+func (d *Device) commandNoteOn(note, velocity uint8) bool {
+	d.mu.Lock()
+	active := d.commandMode
+	d.mu.Unlock()
+	if !active {
+		return false
+	}
+	for _, b := range d.NoteBindings {
+		if !b.matches(note, velocity) {
+			continue
+		}
+		d.startAction("", b.Action)
+		break
+	}
+	return true
+}
+
+func (d *Device) CommandMode() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.commandMode
+}
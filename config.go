@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const CONFIG_FILE = "config.json"
+
+type Config struct {
+	HomeAssistant HomeAssistant `json:"home_assistant"`
+	API           struct {
+		// address of the HTTP control API, e.g. "127.0.0.1:8765"; empty disables it
+		Listen string `json:"listen"`
+	} `json:"api"`
+	// where the scene, default colors and transposition are kept across restarts; empty disables it
+	StateFile string     `json:"state_file"`
+	MQTT      MQTTConfig `json:"mqtt"`
+	// extra named actions, on top of the built-in ones
+	Actions map[string]ActionConfig `json:"actions"`
+	// control (as in controlID, e.g. "TopRowButtons3" or "PlayPressed") -> action run when it is pressed.
+	// A bound control loses its built-in behaviour.
+	Bindings map[string]string `json:"bindings"`
+	// bound control -> color its LED is lit with, see ControlLEDs
+	BindingLights map[string]Color `json:"binding_lights"`
+	// control -> how its LED reacts to it, see FeedbackConfig
+	Feedback map[string]FeedbackConfig `json:"feedback"`
+	// what happens when an action fails, besides flashing its button red
+	Results ResultsConfig `json:"results"`
+	// control -> HA attribute it sets, see ContinuousBinding
+	Continuous map[string]ContinuousBinding `json:"continuous"`
+	ScaleGuide ScaleGuideConfig             `json:"scale_guide"`
+	// practice mode, started with the learn_start action
+	Learn LearnConfig `json:"learn"`
+	// notes played on the keyboard -> actions, while the command_mode action has turned command mode on
+	NoteBindings []NoteBinding `json:"note_bindings"`
+	// step sequencer: ARP edits the steps on the top row, Pattern starts and stops it
+	Sequencer SequencerConfig `json:"sequencer"`
+	// shared clock: Tempo taps it, the right wheel nudges it if wheel_nudge is set, Metro toggles the metronome
+	Tempo TempoConfig `json:"tempo"`
+	// following the MIDI clock and transport of a DAW
+	Sync SyncConfig `json:"sync"`
+	// sending the transport buttons to a DAW instead of their built-in behaviour
+	DAW DAWConfig `json:"daw"`
+	Log LogConfig `json:"log"`
+	// most LED reports written per second; LED_MAX_FPS by default
+	LEDMaxFPS int `json:"led_max_fps"`
+	// LED layout written by the probe command; without it, the guessed LEDs in ControlLEDs are used
+	Layout string `json:"layout"`
+}
+
+type MQTTConfig struct {
+	// e.g. "tcp://127.0.0.1:1883"; empty disables the MQTT bridge
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// base topic for events and commands
+	Topic string `json:"topic"`
+	// prefix of the HA MQTT discovery topics; empty disables discovery
+	DiscoveryPrefix string `json:"discovery_prefix"`
+}
+
+func DefaultConfig() *Config {
+	c := &Config{
+		HomeAssistant: HomeAssistant{
+			Token: haToken,
+			URL:   "http://192.168.1.2:8123/api/",
+		},
+	}
+	c.StateFile = "state.json"
+	c.Layout = "layout.json"
+	c.Sequencer = SequencerConfig{Notes: []uint8{36}, Velocity: 100, Division: 4}
+	c.Tempo = TempoConfig{
+		BPM:            DEFAULT_BPM,
+		MetronomeLED:   M_BUTTON,
+		MetronomeColor: Color{WHITE, 1},
+		AccentColor:    Color{RED, 2},
+		BeatsPerBar:    4,
+	}
+	c.Learn = LearnConfig{LeftColor: Color{PURPLE, 2}, RightColor: Color{LIGHTBLUE, 2}, WrongColor: Color{RED, 2}}
+	c.ScaleGuide = ScaleGuideConfig{Scale: "major", Color: Color{LIGHTBLUE, 1}, RootColor: Color{ORANGE, 2}}
+	c.Continuous = map[string]ContinuousBinding{
+		"BottomRowPitch1": {Entity: "light.bedroom_lights", Attribute: "brightness"},
+	}
+	c.API.Listen = "127.0.0.1:8765"
+	c.MQTT.ClientID = "komplete-kontrol"
+	c.MQTT.Topic = "komplete_kontrol"
+	c.MQTT.DiscoveryPrefix = "homeassistant"
+	return c
+}
+
+// checkColors checks every Color in v, a config or a part of it at path
+func checkColors(v reflect.Value, path string) error {
+	if c, ok := v.Interface().(Color); ok {
+		if err := c.Check(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+	var problems []error
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			problems = append(problems, checkColors(v.Elem(), path))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			fieldPath := path
+			if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); !f.Anonymous {
+				fieldPath = strings.TrimPrefix(path+"."+name, ".")
+			}
+			problems = append(problems, checkColors(v.Field(i), fieldPath))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			problems = append(problems, checkColors(iter.Value(), fmt.Sprintf("%s.%v", path, iter.Key())))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			problems = append(problems, checkColors(v.Index(i), fmt.Sprintf("%s[%d]", path, i)))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// LoadConfig reads the config file over the defaults. A missing file is not an error.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a map in the file would be merged into the default one, so the default continuous binding is only kept
+	// when the file has no continuous key
+	defaultContinuous := c.Continuous
+	c.Continuous = nil
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	if _, ok := keys["continuous"]; !ok {
+		c.Continuous = defaultContinuous
+	}
+	return c, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ContinuousBinding binds a knob ("BottomRowPitch1".."BottomRowPitch8"), the touch strip ("StripValue")
+// or a wheel ("LeftWheelPitch", "RightWheelPitch") to an attribute of a HA entity
+type ContinuousBinding struct {
+	Entity string `json:"entity"`
+	// brightness, color_temp, volume, cover_position or temperature
+	Attribute string `json:"attribute"`
+	// range of the attribute; both zero means the attribute's usual range, otherwise they must differ
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	// for the wheels, the fraction of the range one detent moves; default 0.01
+	Step float64 `json:"step"`
+	// minimum time between two updates while the control moves; default 200
+	ThrottleMs int `json:"throttle_ms"`
+	// where the value is shown while it changes: "strip" (default), "top_row" or "none", see ShowValue
+	Display string `json:"display"`
+	// fraction of the range at each end that sends the end itself, so that it is easy to reach;
+	// 0.05 for brightness and 0 for the other attributes by default
+	Snap *float64 `json:"snap"`
+}
+
+type continuousAttribute struct {
+	service   string
+	field     string
+	min, max  float64
+	precision float64
+	// attribute in the entity state holding the current value, and its scale relative to field
+	stateField string
+	stateScale float64
+	snap       float64
+}
+
+var continuousAttributes = map[string]continuousAttribute{
+	"brightness":     {"light.turn_on", "brightness_pct", 0, 100, 1, "brightness", 100.0 / 255, 0.05},
+	"color_temp":     {"light.turn_on", "color_temp_kelvin", 2200, 6500, 1, "color_temp_kelvin", 1, 0},
+	"volume":         {"media_player.volume_set", "volume_level", 0, 1, 0.01, "volume_level", 1, 0},
+	"cover_position": {"cover.set_cover_position", "position", 0, 100, 1, "current_position", 1, 0},
+	"temperature":    {"climate.set_temperature", "temperature", 16, 26, 0.5, "temperature", 1, 0},
+}
+
+// raw range of the absolute controls
+const (
+	KNOB_MAX  = 1000
+	STRIP_MAX = 255
+)
+
+type continuousControl struct {
+	binding   ContinuousBinding
+	attribute continuousAttribute
+
+	mu sync.Mutex
+	// position in the range, 0-1
+	value     float64
+	known     bool
+	sentValue float64
+	lastSent  time.Time
+	timer     *time.Timer
+}
+
+func newContinuousControl(b ContinuousBinding) (*continuousControl, error) {
+	a, ok := continuousAttributes[b.Attribute]
+	if !ok {
+		return nil, fmt.Errorf("unknown attribute %q", b.Attribute)
+	}
+	if b.Min == 0 && b.Max == 0 {
+		b.Min, b.Max = a.min, a.max
+	}
+	if b.Min == b.Max {
+		return nil, fmt.Errorf("min and max are both %v", b.Min)
+	}
+	if b.Step == 0 {
+		b.Step = 0.01
+	}
+	if b.ThrottleMs == 0 {
+		b.ThrottleMs = 200
+	}
+	if b.Display == "" {
+		b.Display = "strip"
+	}
+	if b.Snap == nil {
+		b.Snap = &a.snap
+	} else if *b.Snap < 0 || *b.Snap >= 0.5 {
+		return nil, fmt.Errorf("snap must be at least 0 and less than 0.5")
+	}
+	return &continuousControl{binding: b, attribute: a, sentValue: -1}, nil
+}
+
+func (d *Device) SetContinuousBindings(bindings map[string]ContinuousBinding) error {
+	d.continuous = make(map[string]*continuousControl)
+	for id, b := range bindings {
+		c, err := newContinuousControl(b)
+		if err != nil {
+			return fmt.Errorf("continuous binding %s: %w", id, err)
+		}
+		d.continuous[id] = c
+	}
+	return nil
+}
+
+// LoadContinuousValues fetches the current values of the bound attributes in the background
+func (d *Device) LoadContinuousValues() {
+	for _, c := range d.continuous {
+		go c.loadValue(d)
+	}
+}
+
+// handleContinuous updates the control bound to field, if any, and reports whether there was one
+func (d *Device) handleContinuous(field string, i int, oldValue, newValue interface{}) bool {
+	c, ok := d.continuous[controlID(field, i)]
+	if !ok {
+		return false
+	}
+	// the first report only tells where the controls are, nobody moved them
+	if oldValue == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch v := newValue.(type) {
+	case int:
+		if field == "BottomRowPitch" {
+			c.value = float64(v) / KNOB_MAX
+		} else {
+			c.value += float64(v-oldValue.(int)) * c.binding.Step
+		}
+	case uint8:
+		if field == "StripValue" {
+			c.value = float64(v) / STRIP_MAX
+		} else {
+			c.value += float64(int8(v-oldValue.(uint8))) * c.binding.Step
+		}
+	}
+	c.value = math.Max(0, math.Min(1, c.value))
+	c.known = true
+	d.ShowValue(c.binding.Display, i, c.value)
+	if wait := time.Duration(c.binding.ThrottleMs)*time.Millisecond - time.Since(c.lastSent); wait > 0 {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(wait, func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.timer = nil
+				c.send(d)
+			})
+		}
+		return true
+	}
+	c.send(d)
+	return true
+}
+
+// releaseContinuous sends the final value of the control without waiting for the throttle
+func (d *Device) releaseContinuous(field string, i int) {
+	c, ok := d.continuous[controlID(field, i)]
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.send(d)
+}
+
+// loadValue fetches the current value from HA, so that the wheels start from it rather than from the bottom of the range
+func (c *continuousControl) loadValue(d *Device) {
+	state, err := d.HA.GetState(c.binding.Entity)
+	if err != nil {
+		haLog.Error("reading", "entity", c.binding.Entity, "err", err)
+		return
+	}
+	v, ok := state.Attributes[c.attribute.stateField].(float64)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.known {
+		c.value = (v*c.attribute.stateScale - c.binding.Min) / (c.binding.Max - c.binding.Min)
+	}
+}
+
+// send calls HA with the current value, unless it was already sent. Called with c.mu held.
+func (c *continuousControl) send(d *Device) {
+	if !c.known {
+		return
+	}
+	v := c.value
+	if snap := *c.binding.Snap; v < snap {
+		v = 0
+	} else if v > 1-snap {
+		v = 1
+	}
+	v = c.binding.Min + v*(c.binding.Max-c.binding.Min)
+	v = math.Round(v/c.attribute.precision) * c.attribute.precision
+	if v == c.sentValue {
+		return
+	}
+	c.sentValue = v
+	c.lastSent = time.Now()
+	data := map[string]interface{}{"entity_id": c.binding.Entity, c.attribute.field: v}
+	go func() {
+		err := d.HA.CallService(c.attribute.service, data)
+		d.reportResult("", c.attribute.service+" "+c.binding.Entity, err)
+	}()
+	haLog.Debug("calling", "service", c.attribute.service, "data", data)
+}
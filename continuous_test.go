@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTouchBoundKnob(t *testing.T) {
+	d := newTestDevice()
+	if err := d.SetContinuousBindings(map[string]ContinuousBinding{"BottomRowPitch3": {Entity: "light.test", Attribute: "brightness"}}); err != nil {
+		t.Fatal(err)
+	}
+	d.ChangesCallback("BottomRowTouched", 2, false, true)
+	d.ChangesCallback("BottomRowTouched", 2, true, false)
+	d.WaitActions()
+	if scene := d.CurrentScene(); scene != "" {
+		t.Errorf("touching a bound knob switched to scene %q", scene)
+	}
+	// knob 4 isn't bound
+	d.ChangesCallback("BottomRowTouched", 3, false, true)
+	d.WaitActions()
+	if scene := d.CurrentScene(); scene != SceneNames[2] {
+		t.Errorf("touching knob 4 switched to scene %q", scene)
+	}
+}
+
+func TestContinuousDefault(t *testing.T) {
+	for content, bound := range map[string]bool{
+		`{}`: true,
+		`{"continuous": {"StripValue": {"entity": "light.test", "attribute": "brightness"}}}`: false,
+		`{"continuous": {}}`: false,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := config.Continuous["BottomRowPitch1"]; ok != bound {
+			t.Errorf("%s: knob 1 bound: %v", content, ok)
+		}
+	}
+}
+
+func TestContinuousRange(t *testing.T) {
+	if _, err := newContinuousControl(ContinuousBinding{Entity: "light.test", Attribute: "brightness", Min: 50, Max: 50}); err == nil {
+		t.Error("empty range accepted")
+	}
+	if _, err := newContinuousControl(ContinuousBinding{Entity: "light.test", Attribute: "brightness", Min: 20, Max: 80}); err != nil {
+		t.Error(err)
+	}
+}
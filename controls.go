@@ -0,0 +1,147 @@
+package main
+
+import "fmt"
+
+// ControlLEDs maps the controls of DeviceState, named as in controlID, to the index of their LED in the 0x80 report.
+// Controls missing here have no LED, or one nobody has found yet. Only M, S, the top row and the selector are known;
+// the buttons at 14-41 are guesses in the order of DeviceState, which follows the panel, around the transport
+// and octave guesses. The layout profile written by ProbeCommand overrides them; it is loaded before anything
+// reads the map.
+var ControlLEDs = map[string]int{
+	"MPressed":              M_BUTTON,
+	"SPressed":              S_BUTTON,
+	"SelectorLeft":          WHEEL_LEFT,
+	"SelectorTop":           WHEEL_TOP,
+	"SelectorBottom":        WHEEL_BOTTOM,
+	"SelectorRight":         WHEEL_RIGHT,
+	"ShiftPressed":          14,
+	"ScalePressed":          15,
+	"ARPPressed":            16,
+	"UndoPressed":           17,
+	"QuantizePressed":       18,
+	"AutoPressed":           19,
+	"ScenePressed":          20,
+	"PatternPressed":        21,
+	"TrackPressed":          22,
+	"KeyModePressed":        23,
+	"ClearPressed":          24,
+	"PresetUpPressed":       25,
+	"LoopPressed":           LOOP_LED,
+	"MetroPressed":          METRO_LED,
+	"TempoPressed":          TEMPO_LED,
+	"PlayPressed":           PLAY_LED,
+	"RecPressed":            REC_LED,
+	"StopPressed":           STOP_LED,
+	"PresetDownPressed":     32,
+	"LeftPressed":           33,
+	"RightPressed":          34,
+	"BrowserPressed":        35,
+	"PlugInPressed":         36,
+	"MixerPressed":          37,
+	"InstancePressed":       38,
+	"MIDIPressed":           39,
+	"OctaveDecreasePressed": OCTAVE_DOWN_LED,
+	"OctaveIncreasePressed": OCTAVE_UP_LED,
+}
+
+// Regions are named groups of LEDs in the 0x80 report; the rows are in order from left to right
+var Regions = map[string][]int{
+	"top_row":   ledRange(TOP_ROW_START, 8),
+	"wheel":     {WHEEL_LEFT, WHEEL_TOP, WHEEL_RIGHT, WHEEL_BOTTOM},
+	"strip":     ledRange(STRIP_START, STRIP_LENGTH),
+	"transport": {LOOP_LED, METRO_LED, TEMPO_LED, PLAY_LED, REC_LED, STOP_LED},
+}
+
+var transportControls = []string{"LoopPressed", "MetroPressed", "TempoPressed", "PlayPressed", "RecPressed", "StopPressed"}
+
+func init() {
+	for i := 0; i < 8; i++ {
+		ControlLEDs[controlID("TopRowButtons", i)] = TOP_ROW_START + i
+	}
+}
+
+// ledOf returns the LED of a control that is known to have one
+func ledOf(control string) int {
+	return ControlLEDs[control]
+}
+
+func ledRange(start, n int) []int {
+	leds := make([]int, n)
+	for i := range leds {
+		leds[i] = start + i
+	}
+	return leds
+}
+
+// ControlLED returns the LED of a control, named as in controlID
+func ControlLED(control string) (int, error) {
+	led, ok := ControlLEDs[control]
+	if !ok {
+		return 0, fmt.Errorf("no known LED for %q", control)
+	}
+	return led, nil
+}
+
+// LightControl sets the color of the LED of a control, and its default color if setDefault is true
+func (d *Device) LightControl(control string, c Color, setDefault bool) error {
+	led, err := ControlLED(control)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.CurrentButtonsBuffer[led] = GetColor(c)
+	if setDefault {
+		d.DefaultButtonsBuffer[led] = GetColor(c)
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	return nil
+}
+
+// LightRegion sets the color of every LED of a region
+func (d *Device) LightRegion(region string, c Color) error {
+	leds, ok := Regions[region]
+	if !ok {
+		return fmt.Errorf("unknown region %q", region)
+	}
+	d.mu.Lock()
+	for _, led := range leds {
+		d.CurrentButtonsBuffer[led] = GetColor(c)
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	return nil
+}
+
+// ShowBindingLights lights the LEDs of bound controls, in the color configured for each, and keeps them lit over scene changes
+func (d *Device) ShowBindingLights(lights map[string]Color) error {
+	if err := d.checkBindingLights(lights); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.bindingLights = lights
+	d.showBindingLights()
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	return nil
+}
+
+func (d *Device) checkBindingLights(lights map[string]Color) error {
+	for control := range lights {
+		if _, ok := d.Bindings[control]; !ok {
+			return fmt.Errorf("%s has a light but no binding", control)
+		}
+		if _, err := ControlLED(control); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// showBindingLights lights the LEDs of bound controls and makes their colors the default. Called with d.mu held.
+func (d *Device) showBindingLights() {
+	for control, c := range d.bindingLights {
+		led := ledOf(control)
+		d.CurrentButtonsBuffer[led], d.DefaultButtonsBuffer[led] = GetColor(c), GetColor(c)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+const (
+	DAW_MMC = "mmc"
+	DAW_MCU = "mcu"
+	// MMC device ID addressing every device
+	MMC_ALL_DEVICES = 0x7f
+)
+
+type DAWConfig struct {
+	// "mmc" sends MIDI Machine Control, "mcu" Mackie Control; empty keeps the built-in behaviour of the transport buttons
+	Mode string `json:"mode"`
+	// substring of the MIDI output port name; empty opens a virtual port
+	Output string `json:"output"`
+	// substring of the MIDI input port the DAW sends Mackie Control feedback to; empty opens a virtual port
+	Input    string `json:"input"`
+	DeviceID uint8  `json:"device_id"`
+}
+
+// transportButton is what a transport button sends to the DAW, and the color of its LED when the DAW turns it on
+type transportButton struct {
+	color Color
+	// Mackie Control note
+	note uint8
+	// MMC command; 0 means none
+	mmc uint8
+}
+
+var transportButtons = map[string]transportButton{
+	"LoopPressed":  {Color{ORANGE, 2}, 0x56, 0},
+	"MetroPressed": {Color{LIGHTBLUE, 2}, 0x59, 0},
+	"PlayPressed":  {Color{GREEN, 2}, 0x5e, 0x02},
+	"RecPressed":   {Color{RED, 2}, 0x5f, 0x06},
+	"StopPressed":  {Color{WHITE, 2}, 0x5d, 0x01},
+}
+
+// dawButton sends a transport button to the DAW and reports whether it did
+func (d *Device) dawButton(field string, pressed bool) bool {
+	b, ok := transportButtons[field]
+	if !ok || d.DAWOut == nil {
+		return false
+	}
+	var err error
+	switch d.DAW.Mode {
+	case DAW_MCU:
+		// the DAW answers with the new state of the LED
+		var velocity uint8
+		if pressed {
+			velocity = 127
+		}
+		d.DAWOut.SetChannel(0)
+		err = writer.NoteOn(d.DAWOut, b.note, velocity)
+	case DAW_MMC:
+		if !pressed || b.mmc == 0 {
+			return true
+		}
+		id := d.DAW.DeviceID
+		if id == 0 {
+			id = MMC_ALL_DEVICES
+		}
+		err = writer.SysEx(d.DAWOut, []byte{0x7f, id, 0x06, b.mmc})
+	default:
+		return false
+	}
+	if err != nil {
+		midiLog.Error("sending to the DAW", "control", field, "err", err)
+	}
+	return true
+}
+
+// ListenMCU lights the transport LEDs from the Mackie Control feedback of the DAW
+func (d *Device) ListenMCU(in midi.In) error {
+	port := in.String()
+	rd := reader.New(
+		reader.NoLogger(),
+		reader.Each(func(p *reader.Position, msg midi.Message) {
+			midiMessages.Inc("port", port)
+		}),
+		reader.NoteOn(func(p *reader.Position, channel, key, vel uint8) {
+			d.mcuLED(key, vel > 0)
+		}),
+		reader.NoteOff(func(p *reader.Position, channel, key, vel uint8) {
+			d.mcuLED(key, false)
+		}),
+	)
+	return rd.ListenTo(in)
+}
+
+func (d *Device) mcuLED(note uint8, on bool) {
+	for field, b := range transportButtons {
+		if b.note != note {
+			continue
+		}
+		led := ledOf(field)
+		c := GetColor(Color{BLACK, 0})
+		if on {
+			c = GetColor(b.color)
+		}
+		d.mu.Lock()
+		d.CurrentButtonsBuffer[led], d.DefaultButtonsBuffer[led] = c, c
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
+		return
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "time"
+
+const (
+	STRIP_LENGTH       = 25
+	VALUE_DISPLAY_TIME = 1500 * time.Millisecond
+	VALUE_FADE_STEP    = 80 * time.Millisecond
+)
+
+var ValueDisplayColor = Color{WHITE, 2}
+
+// ShowValue temporarily shows a 0-1 value as a bar on the strip ("strip") or as the intensity of
+// the top row button above knob index ("top_row"). The LEDs fade back to their defaults once
+// ShowValue hasn't been called for VALUE_DISPLAY_TIME.
+func (d *Device) ShowValue(display string, index int, value float64) {
+	leds := make(map[int]byte)
+	switch display {
+	case "strip":
+		lit := value * STRIP_LENGTH
+		for i := 0; i < STRIP_LENGTH; i++ {
+			switch {
+			case float64(i+1) <= lit:
+				leds[STRIP_START+i] = GetColor(ValueDisplayColor)
+			case float64(i) < lit:
+				// the partially filled LED gets a dimmer shade
+				leds[STRIP_START+i] = GetColor(Color{ValueDisplayColor.Color, uint8((lit - float64(i)) * float64(ValueDisplayColor.Brightness))})
+			default:
+				leds[STRIP_START+i] = GetColor(Color{BLACK, 0})
+			}
+		}
+	case "top_row":
+		if index < 0 || index >= 8 {
+			return
+		}
+		c := GetColor(Color{BLACK, 0})
+		if value > 0 {
+			c = GetColor(Color{ValueDisplayColor.Color, uint8(value*3 + 0.5)})
+		}
+		leds[TOP_ROW_START+index] = c
+	default:
+		return
+	}
+	d.mu.Lock()
+	if d.valueLEDs == nil {
+		d.valueLEDs = make(map[int]bool)
+	}
+	for i, c := range leds {
+		d.CurrentButtonsBuffer[i] = c
+		d.valueLEDs[i] = true
+	}
+	d.valueGeneration++
+	generation := d.valueGeneration
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	time.AfterFunc(VALUE_DISPLAY_TIME, func() { d.fadeValue(generation) })
+}
+
+// fadeValue dims the shown value step by step and then restores the defaults, unless a newer value is shown meanwhile
+func (d *Device) fadeValue(generation int) {
+	for step := 0; step < 4; step++ {
+		d.mu.Lock()
+		if d.valueGeneration != generation {
+			d.mu.Unlock()
+			return
+		}
+		for i := range d.valueLEDs {
+			if c := d.CurrentButtonsBuffer[i]; c%4 > 0 {
+				d.CurrentButtonsBuffer[i] = c - 1
+			} else {
+				d.CurrentButtonsBuffer[i] = 0
+			}
+		}
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
+		time.Sleep(VALUE_FADE_STEP)
+	}
+	d.mu.Lock()
+	if d.valueGeneration == generation {
+		for i := range d.valueLEDs {
+			d.CurrentButtonsBuffer[i] = d.DefaultButtonsBuffer[i]
+		}
+		d.valueLEDs = nil
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+}
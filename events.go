@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// InputEvent is a single decoded change of a control, as reported by ReflectChanges
+type InputEvent struct {
+	Time    time.Time   `json:"time"`
+	Kind    string      `json:"kind"`
+	Control string      `json:"control"`
+	Index   int         `json:"index"`
+	Old     interface{} `json:"old"`
+	Value   interface{} `json:"value"`
+}
+
+// controlKind classifies a DeviceState field as button, touch, encoder, strip or wheel
+func controlKind(field string) string {
+	switch {
+	case field == "StripValue":
+		return "strip"
+	case strings.HasSuffix(field, "WheelPitch"):
+		return "wheel"
+	case strings.HasSuffix(field, "Pitch"):
+		return "encoder"
+	case strings.HasSuffix(field, "Touched"):
+		return "touch"
+	default:
+		return "button"
+	}
+}
+
+// EventBus fans input events out to subscribers. Slow subscribers lose events instead of blocking the HID loop.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan InputEvent]struct{}
+}
+
+func (b *EventBus) Subscribe() chan InputEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan InputEvent]struct{})
+	}
+	ch := make(chan InputEvent, 64)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan InputEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *EventBus) Publish(e InputEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
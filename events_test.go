@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	var b EventBus
+	slow, fast := b.Subscribe(), b.Subscribe()
+	within(t, time.Second, func() {
+		// nobody reads slow: it loses events instead of blocking Publish
+		for i := 0; i < 100; i++ {
+			b.Publish(InputEvent{Control: "TopRowButtons", Index: i})
+			if e := <-fast; e.Index != i {
+				t.Errorf("got event %d, want %d", e.Index, i)
+			}
+		}
+	})
+	if len(slow) != cap(slow) {
+		t.Errorf("slow subscriber holds %d events", len(slow))
+	}
+	b.Unsubscribe(fast)
+	b.Publish(InputEvent{})
+	if len(fast) != 0 {
+		t.Error("published to an unsubscribed channel")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// lit while the button is held
+	FEEDBACK_MOMENTARY = "momentary"
+	// lit and unlit by successive presses
+	FEEDBACK_TOGGLE = "toggle"
+	// flashes green when the bound action succeeds, red when it fails
+	FEEDBACK_RESULT = "result"
+
+	RESULT_FLASH = 500 * time.Millisecond
+)
+
+type FeedbackConfig struct {
+	Mode string `json:"mode"`
+	// color of momentary and toggle; white by default
+	Color *Color `json:"color"`
+}
+
+var (
+	FeedbackColor = Color{WHITE, 2}
+	SuccessColor  = Color{GREEN, 2}
+	ErrorColor    = Color{RED, 2}
+)
+
+// SetFeedback sets how the LEDs of controls, named as in controlID, react to them. Controls without an entry
+// in ControlLEDs are rejected; most entries are guesses, so run probe first to light the right LEDs.
+func (d *Device) SetFeedback(feedback map[string]FeedbackConfig) error {
+	for control, f := range feedback {
+		switch f.Mode {
+		case FEEDBACK_MOMENTARY, FEEDBACK_TOGGLE, FEEDBACK_RESULT:
+		default:
+			return fmt.Errorf("feedback of %s: unknown mode %q", control, f.Mode)
+		}
+		if _, err := ControlLED(control); err != nil {
+			return fmt.Errorf("feedback of %s: %w", control, err)
+		}
+	}
+	d.Feedback = feedback
+	return nil
+}
+
+// pressFeedback lights the LED of a momentary or toggle control when it is pressed or released
+func (d *Device) pressFeedback(control string, pressed bool) {
+	f, ok := d.Feedback[control]
+	if !ok {
+		return
+	}
+	c := FeedbackColor
+	if f.Color != nil {
+		c = *f.Color
+	}
+	lit := pressed
+	switch f.Mode {
+	case FEEDBACK_MOMENTARY:
+	case FEEDBACK_TOGGLE:
+		if !pressed {
+			return
+		}
+		d.mu.Lock()
+		if d.toggled == nil {
+			d.toggled = make(map[string]bool)
+		}
+		d.toggled[control] = !d.toggled[control]
+		lit = d.toggled[control]
+		d.mu.Unlock()
+	default:
+		return
+	}
+	if lit {
+		d.LightControl(control, c, false)
+	} else {
+		d.restoreControl(control)
+	}
+}
+
+// resultFeedback flashes the LED of a control red when its action failed, or green when it succeeded and the control's feedback is "result"
+func (d *Device) resultFeedback(control string, err error) {
+	c := ErrorColor
+	if err == nil {
+		if f, ok := d.Feedback[control]; !ok || f.Mode != FEEDBACK_RESULT {
+			return
+		}
+		c = SuccessColor
+	}
+	if d.LightControl(control, c, false) != nil {
+		return
+	}
+	time.AfterFunc(RESULT_FLASH, func() {
+		d.restoreControl(control)
+	})
+}
+
+// restoreControl shows the default color of the LED of a control
+func (d *Device) restoreControl(control string) {
+	led, err := ControlLED(control)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	d.CurrentButtonsBuffer[led] = d.DefaultButtonsBuffer[led]
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+}
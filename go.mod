@@ -0,0 +1,16 @@
+module komplete-kontrol
+
+go 1.21
+
+require (
+	github.com/Mihonarium/go-hid v0.14.1
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	gitlab.com/gomidi/midi v1.23.7
+	gitlab.com/gomidi/rtmididrv v0.14.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+)
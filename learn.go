@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gitlab.com/gomidi/midi/reader"
+)
+
+const WRONG_NOTE_FLASH = 300 * time.Millisecond
+
+type LearnConfig struct {
+	File string `json:"file"`
+	// tracks of each hand; tracks in neither list are ignored, and if both are empty every track is the right hand's
+	LeftTracks  []int `json:"left_tracks"`
+	RightTracks []int `json:"right_tracks"`
+	// "both" (default), "left" or "right"
+	Hands string `json:"hands"`
+	// 1-based range of steps to repeat; 0 means from the first or to the last step
+	LoopStart  int   `json:"loop_start"`
+	LoopEnd    int   `json:"loop_end"`
+	LeftColor  Color `json:"left_color"`
+	RightColor Color `json:"right_color"`
+	WrongColor Color `json:"wrong_color"`
+}
+
+const (
+	LEFT_HAND  = 1
+	RIGHT_HAND = 2
+)
+
+// learnStep is a chord: the notes starting at the same tick, with the hand playing each
+type learnStep struct {
+	ticks uint64
+	notes map[uint8]int
+}
+
+type learnSession struct {
+	config    LearnConfig
+	steps     []learnStep
+	pos       int
+	loopStart int
+	loopEnd   int
+	pressed   map[uint8]bool
+}
+
+// LoadLearnSteps reads the notes of the selected tracks and hands from a MIDI file
+func LoadLearnSteps(c LearnConfig) ([]learnStep, error) {
+	hands := make(map[int16]int)
+	for _, t := range c.LeftTracks {
+		hands[int16(t)] = LEFT_HAND
+	}
+	for _, t := range c.RightTracks {
+		hands[int16(t)] = RIGHT_HAND
+	}
+	byTicks := make(map[uint64]map[uint8]int)
+	rd := reader.New(
+		reader.NoLogger(),
+		reader.NoteOn(func(p *reader.Position, channel, key, vel uint8) {
+			if vel == 0 {
+				return
+			}
+			hand := RIGHT_HAND
+			if len(hands) > 0 {
+				hand = hands[p.Track]
+			}
+			if hand == 0 || (c.Hands == "left" && hand != LEFT_HAND) || (c.Hands == "right" && hand != RIGHT_HAND) {
+				return
+			}
+			if byTicks[p.AbsoluteTicks] == nil {
+				byTicks[p.AbsoluteTicks] = make(map[uint8]int)
+			}
+			byTicks[p.AbsoluteTicks][key] = hand
+		}),
+	)
+	if err := reader.ReadSMFFile(rd, c.File); err != nil {
+		return nil, err
+	}
+	steps := make([]learnStep, 0, len(byTicks))
+	for ticks, notes := range byTicks {
+		steps = append(steps, learnStep{ticks, notes})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].ticks < steps[j].ticks })
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no notes to learn in %s", c.File)
+	}
+	return steps, nil
+}
+
+// StartLearning lights the first notes of the configured file and waits for them to be played
+func (d *Device) StartLearning() error {
+	c := d.LearnConfig
+	steps, err := LoadLearnSteps(c)
+	if err != nil {
+		return err
+	}
+	s := &learnSession{config: c, steps: steps, loopStart: 0, loopEnd: len(steps) - 1}
+	if c.LoopStart > 0 && c.LoopStart <= len(steps) {
+		s.loopStart = c.LoopStart - 1
+	}
+	if c.LoopEnd > 0 && c.LoopEnd <= len(steps) && c.LoopEnd-1 >= s.loopStart {
+		s.loopEnd = c.LoopEnd - 1
+	}
+	d.mu.Lock()
+	defer d.MarkDirty(true, false)
+	defer d.mu.Unlock()
+	d.litNotes = make(map[uint8]litNote)
+	copy(d.CurrentKeysBuffer, d.DefaultKeysBuffer)
+	d.learn = s
+	if !d.checkLearnRange() {
+		d.learn = nil
+		return fmt.Errorf("no note of %s is on the keyboard at this transposition", c.File)
+	}
+	d.showLearnStep(s.loopStart)
+	return nil
+}
+
+// onKeyboard reports whether a note is played by a key at the current transposition. Called with d.mu held.
+func (d *Device) onKeyboard(note uint8) bool {
+	key := d.noteKey(note)
+	return key >= 0 && key < NB_KEYS
+}
+
+// checkLearnRange warns about the notes being learnt that no key plays at the current transposition; they are skipped.
+// It reports whether any note is left. Called with d.mu held.
+func (d *Device) checkLearnRange() bool {
+	outside, left := d.learnNotesOffKeyboard(d.learn.steps)
+	if len(outside) > 0 {
+		inputLog.Warn("notes to learn outside of the keyboard are skipped, transpose to play them",
+			"notes", len(outside), "lowest", outside[0], "highest", outside[len(outside)-1])
+	}
+	return left
+}
+
+func (d *Device) StopLearning() {
+	d.mu.Lock()
+	d.learn = nil
+	copy(d.CurrentKeysBuffer, d.DefaultKeysBuffer)
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+}
+
+func (d *Device) Learning() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.learn != nil
+}
+
+// learnNotesOffKeyboard returns the notes of steps that no key plays at the current transposition, in order,
+// and whether any note is left. Called with d.mu held.
+func (d *Device) learnNotesOffKeyboard(steps []learnStep) ([]uint8, bool) {
+	var outside []uint8
+	left := false
+	for _, step := range steps {
+		for note := range step.notes {
+			if d.onKeyboard(note) {
+				left = true
+			} else {
+				outside = append(outside, note)
+			}
+		}
+	}
+	sort.Slice(outside, func(i, j int) bool { return outside[i] < outside[j] })
+	return outside, left
+}
+
+// showLearnStep clears the current step and lights the notes of step pos.
+// Steps with no note on the keyboard are skipped. Called with d.mu held.
+func (d *Device) showLearnStep(pos int) {
+	s := d.learn
+	d.clearLearnStep()
+	for i := 0; i <= s.loopEnd-s.loopStart && !d.learnStepPlayable(pos); i++ {
+		pos = d.nextLearnStep(pos)
+	}
+	s.pos = pos
+	s.pressed = make(map[uint8]bool)
+	d.lightLearnStep()
+	inputLog.Info("learn step", "step", pos+1, "steps", len(s.steps))
+}
+
+// clearLearnStep shows the default colors of the keys of the current step. Called with d.mu held.
+func (d *Device) clearLearnStep() {
+	for note := range d.learn.steps[d.learn.pos].notes {
+		if d.onKeyboard(note) {
+			key := d.noteKey(note)
+			d.CurrentKeysBuffer[key] = d.DefaultKeysBuffer[key]
+		}
+	}
+}
+
+// lightLearnStep lights the keys of the current step. Called with d.mu held.
+func (d *Device) lightLearnStep() {
+	for note := range d.learn.steps[d.learn.pos].notes {
+		if d.onKeyboard(note) {
+			d.CurrentKeysBuffer[d.noteKey(note)] = d.learnKeyColor(note)
+		}
+	}
+}
+
+// learnStepPlayable reports whether a step has a note on the keyboard. Called with d.mu held.
+func (d *Device) learnStepPlayable(pos int) bool {
+	for note := range d.learn.steps[pos].notes {
+		if d.onKeyboard(note) {
+			return true
+		}
+	}
+	return false
+}
+
+// learnStepDone reports whether every note of the current step on the keyboard was played. Called with d.mu held.
+func (d *Device) learnStepDone() bool {
+	s := d.learn
+	for note := range s.steps[s.pos].notes {
+		if d.onKeyboard(note) && !s.pressed[note] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Device) nextLearnStep(pos int) int {
+	if pos+1 > d.learn.loopEnd {
+		return d.learn.loopStart
+	}
+	return pos + 1
+}
+
+// learnKeyColor is the color of a key during practice. Called with d.mu held.
+func (d *Device) learnKeyColor(note uint8) byte {
+	s := d.learn
+	hand, required := s.steps[s.pos].notes[note]
+	switch {
+	case !required:
+		return d.DefaultKeysBuffer[d.noteKey(note)]
+	case s.pressed[note]:
+		return GetColor(Color{GREEN, 2})
+	case hand == LEFT_HAND:
+		return GetColor(s.config.LeftColor)
+	default:
+		return GetColor(s.config.RightColor)
+	}
+}
+
+// learnNoteOn checks a played note against the current step, and reports whether practice is on
+func (d *Device) learnNoteOn(note uint8) bool {
+	d.mu.Lock()
+	s := d.learn
+	if s == nil {
+		d.mu.Unlock()
+		return false
+	}
+	key := d.noteKey(note)
+	if key < 0 || key >= NB_KEYS {
+		d.mu.Unlock()
+		return true
+	}
+	if _, required := s.steps[s.pos].notes[note]; !required {
+		d.CurrentKeysBuffer[key] = GetColor(s.config.WrongColor)
+		d.mu.Unlock()
+		d.MarkDirty(true, false)
+		time.AfterFunc(WRONG_NOTE_FLASH, func() {
+			d.mu.Lock()
+			// unless the keyboard was transposed since
+			if d.learn == s && d.noteKey(note) == key {
+				d.CurrentKeysBuffer[key] = d.learnKeyColor(note)
+			}
+			d.mu.Unlock()
+			d.MarkDirty(true, false)
+		})
+		return true
+	}
+	s.pressed[note] = true
+	d.CurrentKeysBuffer[key] = d.learnKeyColor(note)
+	if d.learnStepDone() {
+		d.showLearnStep(d.nextLearnStep(s.pos))
+	}
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+	return true
+}
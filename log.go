@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+type LogConfig struct {
+	// "debug", "info" (default), "warn" or "error"
+	Level string `json:"level"`
+	// subsystem (hid, midi, ha, anim, input, mqtt or app) -> its level, instead of Level
+	Subsystems map[string]string `json:"subsystems"`
+	JSON       bool              `json:"json"`
+}
+
+// a logger per subsystem, replaced by SetupLogging
+var (
+	hidLog   = newLogger("hid", false, slog.LevelInfo)
+	midiLog  = newLogger("midi", false, slog.LevelInfo)
+	haLog    = newLogger("ha", false, slog.LevelInfo)
+	animLog  = newLogger("anim", false, slog.LevelInfo)
+	inputLog = newLogger("input", false, slog.LevelInfo)
+	mqttLog  = newLogger("mqtt", false, slog.LevelInfo)
+	appLog   = newLogger("app", false, slog.LevelInfo)
+)
+
+var loggers = map[string]**slog.Logger{
+	"hid":   &hidLog,
+	"midi":  &midiLog,
+	"ha":    &haLog,
+	"anim":  &animLog,
+	"input": &inputLog,
+	"mqtt":  &mqttLog,
+	"app":   &appLog,
+}
+
+func newLogger(subsystem string, json bool, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if json {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	return slog.New(handler).With("subsystem", subsystem)
+}
+
+// SetupLogging replaces the loggers of the subsystems; verbose logs everything at the debug level
+func SetupLogging(c LogConfig, verbose bool) error {
+	level, err := parseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	for subsystem := range c.Subsystems {
+		if _, ok := loggers[subsystem]; !ok {
+			return fmt.Errorf("unknown log subsystem %q", subsystem)
+		}
+	}
+	for subsystem, logger := range loggers {
+		l := level
+		if s, ok := c.Subsystems[subsystem]; ok {
+			if l, err = parseLevel(s); err != nil {
+				return err
+			}
+		}
+		if verbose {
+			l = slog.LevelDebug
+		}
+		*logger = newLogger(subsystem, c.JSON, l)
+	}
+	return nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
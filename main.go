@@ -2,31 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/Mihonarium/go-hid"
 	"gitlab.com/gomidi/midi"
-	"gitlab.com/gomidi/midi/reader"
-	"gitlab.com/gomidi/midi/smf"
 	"gitlab.com/gomidi/midi/writer"
 	"gitlab.com/gomidi/rtmididrv"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"reflect"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type HomeAssistant struct {
-	Token string
-	URL   string
+	Token string `json:"token"`
+	URL   string `json:"url"`
 }
 
-var ha HomeAssistant
-
 func MIDINote(wr writer.ChannelWriter, note uint8, velocity uint8, channel int8) {
-	fmt.Println("MIDINote", note, velocity, channel)
+	midiLog.Debug("MIDINote", "note", note, "velocity", velocity, "channel", channel)
 	if channel != -1 {
 		wr.SetChannel(uint8(channel))
 	}
@@ -47,15 +45,25 @@ func (ha *HomeAssistant) CallHomeAssistant(haPath string, haMethod string, haBod
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+ha.Token)
+	service := haService(haPath)
+	start := time.Now()
 	resp, err = http.DefaultClient.Do(req)
+	haCallTime.ObserveSince(start, "service", service)
 	if err != nil {
+		haCalls.Inc("service", service, "outcome", "error")
 		return "", err
 	}
 	defer resp.Body.Close()
 	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
+		haCalls.Inc("service", service, "outcome", "error")
 		return "", err
 	}
+	if resp.StatusCode >= 300 {
+		haCalls.Inc("service", service, "outcome", "error")
+		return string(body), fmt.Errorf("home assistant returned %s: %s", resp.Status, body)
+	}
+	haCalls.Inc("service", service, "outcome", "success")
 	return string(body), nil
 }
 
@@ -64,24 +72,6 @@ func getJson(v interface{}) string {
 	return string(b)
 }
 
-func (ha *HomeAssistant) TTS(message, lang, entity, volume string) error {
-	type VolumeChange struct {
-		Volume string `json:"volume_level"`
-		Entity string `json:"entity_id"`
-	}
-	_, err := ha.CallHomeAssistant("services/media_player/volume_set", "POST", getJson(VolumeChange{Volume: volume, Entity: entity}))
-	if err != nil {
-		return err
-	}
-	type TTS struct {
-		Message  string `json:"message"`
-		Language string `json:"language"`
-		Entity   string `json:"entity_id"`
-	}
-	_, err = ha.CallHomeAssistant("services/tts/google_translate_say", "POST", getJson(TTS{Message: message, Language: lang, Entity: entity}))
-	return err
-}
-
 func bytesConc(b1 []byte, b2 []byte) []byte {
 	b := make([]byte, len(b1)+len(b2))
 	copy(b, b1)
@@ -92,28 +82,28 @@ func bytesConc(b1 []byte, b2 []byte) []byte {
 func (d *Device) WriteKeyColor(key int, color byte) {
 	/*key := note + OFFSET*/
 	if key < 0 || key >= NB_KEYS {
-		fmt.Println("Key out of range", key)
+		hidLog.Warn("key out of range", "key", key)
 		return
 	}
-	d.Lock()
+	d.mu.Lock()
 	d.CurrentKeysBuffer[key] = color
-	d.Unlock()
-	d.WriteBuffer()
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
 }
 func (d *Device) WriteButtonColor(button int, color byte) {
 	if button < 0 || button >= NB_BUTTONS {
-		fmt.Println("Button out of range", button)
+		hidLog.Warn("button out of range", "button", button)
 		return
 	}
-	d.Lock()
+	d.mu.Lock()
 	d.CurrentButtonsBuffer[button] = color
-	d.Unlock()
-	d.WriteBuffer()
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
 }
 func (d *Device) GetDefaultBuffers() ([]byte, []byte) {
-	d.Lock()
-	defer d.Unlock()
-	return d.DefaultButtonsBuffer, d.DefaultKeysBuffer
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byte(nil), d.DefaultButtonsBuffer...), append([]byte(nil), d.DefaultKeysBuffer...)
 }
 
 const NB_KEYS = 61
@@ -123,26 +113,53 @@ const PRODUCT_ID = 0x1620
 const SERIAL_NUMBER = "0CD3B416"
 const OFFSET = -36
 
-var octaveShift = 0
+// LED_MAX_FPS is the default limit on how often the LED reports are flushed to the device
+const LED_MAX_FPS = 60
 
 func (d *Device) LightsOff() {
-	d.Lock()
-	d.CurrentKeysBuffer = make([]byte, 249)
-	d.CurrentButtonsBuffer = make([]byte, 249)
-	d.Unlock()
+	d.mu.Lock()
+	// the buffers are cleared in place: they are never replaced, so nobody can hold a stale slice
+	for i := range d.CurrentKeysBuffer {
+		d.CurrentKeysBuffer[i] = 0
+	}
+	for i := range d.CurrentButtonsBuffer {
+		d.CurrentButtonsBuffer[i] = 0
+	}
+	d.mu.Unlock()
 	d.WriteBuffer()
 }
 
 func (d *Device) SetCurrentKeysAsDefault() {
-	d.Lock()
-	defer d.Unlock()
-	copy(d.DefaultKeysBuffer, d.CurrentKeysBuffer)
+	d.mu.Lock()
+	if d.scaleGuide != nil {
+		// the new colors show up once the scale guide is turned off
+		copy(d.scaleGuide.savedKeys, d.CurrentKeysBuffer)
+		d.renderScaleGuide()
+	} else {
+		copy(d.DefaultKeysBuffer, d.CurrentKeysBuffer)
+	}
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+	d.saveStateLater()
 }
 
 func (d *Device) SetCurrentButtonsAsDefault() {
-	d.Lock()
-	defer d.Unlock()
+	d.mu.Lock()
 	copy(d.DefaultButtonsBuffer, d.CurrentButtonsBuffer)
+	// the LEDs showing a state keep showing it, whatever was written over them
+	d.showTransposition()
+	d.showBindingLights()
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	d.saveStateLater()
+}
+
+func (d *Device) RestoreDefaults() {
+	d.mu.Lock()
+	copy(d.CurrentKeysBuffer, d.DefaultKeysBuffer)
+	copy(d.CurrentButtonsBuffer, d.DefaultButtonsBuffer)
+	d.mu.Unlock()
+	d.WriteBuffer()
 }
 
 // Device info
@@ -172,12 +189,73 @@ const (
 )
 
 func (d *Device) WriteBuffer() {
-	go func() {
-		d.Lock()
-		d.WriteToDevice(0x81, d.CurrentKeysBuffer)
-		d.WriteToDevice(0x80, d.CurrentButtonsBuffer)
-		d.Unlock()
-	}()
+	d.MarkDirty(true, true)
+}
+
+// MarkDirty schedules the keys (0x81) and/or buttons (0x80) report to be sent by the LED writer.
+// Several calls between two flushes are coalesced into a single write of the latest buffers.
+func (d *Device) MarkDirty(keys, buttons bool) {
+	d.mu.Lock()
+	d.keysDirty = d.keysDirty || keys
+	d.buttonsDirty = d.buttonsDirty || buttons
+	d.mu.Unlock()
+	select {
+	case d.flush <- struct{}{}:
+	default:
+	}
+}
+
+// FlushLEDs writes both reports through the LED writer, which must be running, and waits until they are written
+func (d *Device) FlushLEDs() {
+	done := make(chan struct{})
+	d.mu.Lock()
+	d.flushed = append(d.flushed, done)
+	d.mu.Unlock()
+	d.MarkDirty(true, true)
+	<-done
+}
+
+// StartLEDWriter starts the only goroutine that writes LED reports to the device, at most MaxFrameRate times per second
+func (d *Device) StartLEDWriter() {
+	maxFrameRate := d.MaxFrameRate
+	if maxFrameRate <= 0 {
+		maxFrameRate = LED_MAX_FPS
+	}
+	d.flush = make(chan struct{}, 1)
+	go d.ledWriter(time.Second / time.Duration(maxFrameRate))
+}
+
+func (d *Device) ledWriter(minInterval time.Duration) {
+	keys := make([]byte, len(d.CurrentKeysBuffer))
+	buttons := make([]byte, len(d.CurrentButtonsBuffer))
+	var lastWrite time.Time
+	for range d.flush {
+		if wait := minInterval - time.Since(lastWrite); wait > 0 {
+			time.Sleep(wait)
+		}
+		// the buffers are copied only now, so whatever was written during the wait is what gets sent
+		d.mu.Lock()
+		writeKeys, writeButtons := d.keysDirty, d.buttonsDirty
+		d.keysDirty, d.buttonsDirty = false, false
+		copy(keys, d.CurrentKeysBuffer)
+		copy(buttons, d.CurrentButtonsBuffer)
+		flushed := d.flushed
+		d.flushed = nil
+		d.mu.Unlock()
+		if writeKeys {
+			d.WriteToDevice(0x81, keys)
+		}
+		if writeButtons {
+			d.WriteToDevice(0x80, buttons)
+		}
+		for _, done := range flushed {
+			close(done)
+		}
+		if name := d.CurrentAnimation(); name != "" {
+			animFrames.Inc("animation", name)
+		}
+		lastWrite = time.Now()
+	}
 }
 
 type Color struct {
@@ -209,6 +287,17 @@ const (
 	WHITE      uint8 = 17
 )
 
+// Check reports a color or brightness the LEDs don't have
+func (c Color) Check() error {
+	if c.Color > WHITE {
+		return fmt.Errorf("color must be between 0 and %d", WHITE)
+	}
+	if c.Brightness > 3 {
+		return fmt.Errorf("brightness must be between 0 and 3")
+	}
+	return nil
+}
+
 func GetColor(c Color) byte {
 	return c.Color*4 + c.Brightness
 }
@@ -239,59 +328,70 @@ func (d *Device) FillColorfulButtons(color Color) {
 }
 
 func (d *Device) WriteKeys(colors []Color) {
-	go func() {
-		d.Lock()
-		for i, c := range colors {
-			d.CurrentKeysBuffer[i] = GetColor(c)
-		}
-		d.WriteToDevice(0x81, d.CurrentKeysBuffer)
-		d.Unlock()
-	}()
+	d.mu.Lock()
+	for i, c := range colors {
+		d.CurrentKeysBuffer[i] = GetColor(c)
+	}
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
 }
 
 func (d *Device) WriteButtons(colors []Color) {
-	go func() {
-		d.Lock()
-		for i, c := range colors {
-			d.CurrentButtonsBuffer[i] = GetColor(c)
-		}
-		d.WriteToDevice(0x80, d.CurrentButtonsBuffer)
-		d.Unlock()
-	}()
+	d.mu.Lock()
+	for i, c := range colors {
+		d.CurrentButtonsBuffer[i] = GetColor(c)
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
 }
 
 func (d *Device) WriteToDevice(where byte, data []byte) {
+	if d.onWrite != nil {
+		d.onWrite(where, data)
+	}
+	// no keyboard, e.g. when replaying a capture
+	if d.Device == nil {
+		return
+	}
+	start := time.Now()
 	d.Device.Write(bytesConc([]byte{where}, data))
+	hidWriteTime.ObserveSince(start)
+	hidWrites.Inc("report", fmt.Sprintf("0x%x", where))
 }
 
-var ShowingScenes = false
-
 func (d *Device) ShowScenes() {
-	if ShowingScenes {
+	d.mu.Lock()
+	if d.showingScenes {
+		d.mu.Unlock()
 		d.ShowDefault()
 		return
 	}
-	ShowingScenes = true
-	d.Lock()
+	d.showingScenes = true
 	d.CurrentButtonsBuffer[TOP_ROW_START+1] = GetColor(Color{RED, 2})
 	d.CurrentButtonsBuffer[TOP_ROW_START+2] = GetColor(Color{WHITE, 3})
 	d.CurrentButtonsBuffer[TOP_ROW_START+3] = GetColor(Color{BLACK, 2})
 	d.CurrentButtonsBuffer[TOP_ROW_START+4] = GetColor(Color{GREEN, 2})
 	d.CurrentButtonsBuffer[TOP_ROW_START+5] = GetColor(Color{BLUE, 2})
-	d.Unlock()
+	d.mu.Unlock()
 	d.WriteBuffer()
 }
 func (d *Device) ShowDefault() {
-	ShowingScenes = false
-	d.Lock()
+	d.mu.Lock()
+	d.showingScenes = false
 	for i := 0; i < 8; i++ {
 		d.CurrentButtonsBuffer[TOP_ROW_START+i] = d.DefaultButtonsBuffer[TOP_ROW_START+i]
 	}
-	d.Unlock()
+	d.mu.Unlock()
 	d.WriteBuffer()
 }
 
-func (d *Device) SendScene(scene int) {
+func (d *Device) SendScene(scene int) error {
+	if scene < 0 || scene >= len(SceneNames) {
+		return fmt.Errorf("unknown scene %d", scene)
+	}
+	d.mu.Lock()
+	d.scene = SceneNames[scene]
+	d.mu.Unlock()
 	call := "services/script/turn_on"
 	body := ""
 	switch scene {
@@ -323,177 +423,153 @@ func (d *Device) SendScene(scene int) {
 		d.SetCurrentKeysAsDefault()
 		d.SetCurrentButtonsAsDefault()
 	}
-	go func() {
-		_, err := ha.CallHomeAssistant(call, "POST", body)
-		if err != nil {
-			fmt.Println("Error calling home assistant", err)
-		}
-	}()
-	fmt.Println("Sent to HA", call, body)
-}
-func ChangeBrightness(brightnessPct int) {
-	call := "services/light/turn_on"
-	body := getJson(map[string]string{"entity_id": "light.bedroom_lights", "brightness_pct": strconv.Itoa(brightnessPct)})
-	go func() {
-		_, err := ha.CallHomeAssistant(call, "POST", body)
-		if err != nil {
-			fmt.Println("Error calling home assistant", err)
-		}
-	}()
-	fmt.Println("Sent to HA", call, body)
+	haLog.Info("calling", "call", call, "body", body)
+	_, err := d.HA.CallHomeAssistant(call, "POST", body)
+	return err
 }
-func (d *Device) LaunchRickRoll() {
+
+// LaunchRickRoll triggers the rickroll automation and plays the animation, even if the automation failed
+func (d *Device) LaunchRickRoll() error {
 	call := "services/automation/trigger"
 	body := getJson(map[string]string{"entity_id": "automation.rickroll"})
-	go func() {
-		_, err := ha.CallHomeAssistant(call, "POST", body)
-		if err != nil {
-			fmt.Println("Error calling home assistant", err)
-		}
-		go d.ColorfulLights(1)
-	}()
-	fmt.Println("Sent to HA", call, body)
+	haLog.Info("calling", "call", call, "body", body)
+	_, err := d.HA.CallHomeAssistant(call, "POST", body)
+	d.StartAnimation("rickroll")
+	return err
 }
 
-func (d *Device) ColorfulLights(mode int) {
-	//ToDO: rainbow and other animation? reacting to music?
-	d.Lock()
-	p := d.PlayingAnimation
-	d.Unlock()
-	if p {
+func (d *Device) ChangesCallback(field string, i int, oldValue, newValue interface{}) {
+	d.Events.Publish(InputEvent{Time: time.Now(), Kind: controlKind(field), Control: field, Index: i, Old: oldValue, Value: newValue})
+	control := controlID(field, i)
+	if pressed, ok := newValue.(bool); ok && oldValue != nil {
+		d.pressFeedback(control, pressed)
+	}
+	if action, ok := d.Bindings[control]; ok {
+		if pressed, _ := newValue.(bool); pressed {
+			d.startAction(control, action)
+		}
 		return
 	}
-	d.Lock()
-	d.PlayingAnimation = true
-	d.Unlock()
-
-	if mode == 0 {
-		go func() {
-			t := time.NewTicker(time.Second / 30)
-			previousColor := Color{1, 2}
-			currentColor := Color{1, 2}
-			var i int
-			for range t.C {
-				d.Lock()
-				d.CurrentKeysBuffer[30+i] = GetColor(currentColor)
-				d.CurrentKeysBuffer[30-i] = GetColor(currentColor)
-				d.CurrentButtonsBuffer[68-i] = GetColor(previousColor)
-				if i < 8 {
-					d.CurrentButtonsBuffer[5-i/2] = GetColor(currentColor)
-					d.CurrentButtonsBuffer[5+i/2+1] = GetColor(currentColor)
-				}
-				if i == 13 {
-					d.CurrentButtonsBuffer[1] = GetColor(currentColor)
-				}
-				if i == 14 {
-					d.CurrentButtonsBuffer[0] = GetColor(currentColor)
-				}
-				d.Unlock()
-				d.WriteBuffer()
-				i++
-				if i > NB_KEYS/2 {
-					previousColor = currentColor
-					i = 0
-					currentColor.Color++
-					if currentColor.Color == 16 {
-						currentColor.Color = 1
-						//currentColor.Brightness++
-					}
-				}
-			}
-		}()
+	if pressed, ok := newValue.(bool); ok && d.dawButton(field, pressed) {
+		return
 	}
-
-	if mode == 1 {
-		// time.Sleep(time.Second * 1)
-		d.LightsOff()
-		d.SetCurrentKeysAsDefault()
-		go func() {
-			t := time.NewTicker(time.Minute / 131)
-			go func() {
-				time.Sleep(time.Minute*3 + time.Second*32)
-				t.Stop()
-			}()
-			currentPlayTOn := false
-			for range t.C {
-				if currentPlayTOn {
-					currentPlayTOn = false
-					d.Lock()
-					d.CurrentButtonsBuffer[29] = GetColor(Color{WHITE, 2})
-					d.Unlock()
-					d.WriteBuffer()
-				} else {
-					currentPlayTOn = true
-					d.Lock()
-					d.CurrentButtonsBuffer[29] = GetColor(Color{BLACK, 2})
-					d.Unlock()
-					d.WriteBuffer()
-				}
-			}
-		}()
-		resolution := smf.MetricTicks(404)
-		rd := reader.New(
-			reader.NoLogger(),
-			// write every message to the out port
-			reader.NoteOn(func(p *reader.Position, channel, key, vel uint8) {
-				fmt.Printf("Track: %v Pos: %v NoteOn (ch %v: key %v)\n", p.Track, p.AbsoluteTicks, channel, key)
-				time.Sleep(resolution.Duration(113, p.DeltaTicks))
-				d.NoteOnCallback(key, channel, vel)
-			}),
-			reader.NoteOff(func(p *reader.Position, channel, key, vel uint8) {
-				fmt.Printf("Track: %v Pos: %v NoteOff (ch %v: key %v)\n", p.Track, p.AbsoluteTicks, channel, key)
-				time.Sleep(resolution.Duration(113, p.DeltaTicks))
-				d.NoteOffCallback(key, channel)
-			}),
-		)
-		err := reader.ReadSMFFile(rd, "Never-Gonna-Give-You-Up-3.mid")
-		must(err)
+	if d.handleContinuous(field, i, oldValue, newValue) {
+		return
+	}
+	// touching a bound knob is part of turning it, not a scene switch
+	if _, bound := d.continuous[controlID("BottomRowPitch", i)]; bound && field == "BottomRowTouched" {
+		if !newValue.(bool) {
+			d.releaseContinuous("BottomRowPitch", i)
+		}
+		return
+	}
+	if field == "RightWheelPitch" && oldValue != nil && d.TempoConfig.WheelNudge {
+		d.Tempo.Nudge(float64(newValue.(int) - oldValue.(int)))
+		inputLog.Info("tempo", "bpm", d.Tempo.BPM())
+		return
+	}
+	if field == "TopRowButtons" && d.SequencerEditing() {
+		if newValue.(bool) {
+			d.ToggleStep(i)
+		}
+		return
 	}
-}
-
-func (d *Device) ChangesCallback(field string, i int, oldValue, newValue interface{}) {
 	if field == "BottomRowTouched" || field == "TopRowButtons" || field == "SPressed" {
 		switch i {
 		case 0:
-			if newValue.(bool) {
-				d.ShowScenes()
+			d.ShowScenes()
+		default:
+			if newValue.(bool) && i-1 < len(SceneNames) {
+				d.startAction(control, "scene_"+SceneNames[i-1])
+			}
+		}
+	} else if field == "OctaveDecreasePressed" || field == "OctaveIncreasePressed" {
+		if newValue.(bool) {
+			step := 1
+			if field == "OctaveDecreasePressed" {
+				step = -1
+			}
+			// like on the keyboard itself, Shift+Octave transposes by semitones
+			if d.GetState().ShiftPressed {
+				d.Transpose(0, step)
 			} else {
-				d.ShowScenes()
-				brightness := d.State.BottomRowPitch[0] / 10
-				if brightness > 95 {
-					brightness = 100
-				}
-				if brightness < 5 {
-					brightness = 0
-				}
-				ChangeBrightness(brightness)
+				d.Transpose(step, 0)
 			}
-		default:
-			if newValue.(bool) {
-				d.SendScene(i - 1)
+		}
+	} else if field == "ScalePressed" {
+		if newValue.(bool) {
+			d.ToggleScaleGuide()
+		}
+	} else if strings.HasPrefix(field, "Selector") && d.ScaleGuideActive() {
+		if pressed, _ := newValue.(bool); pressed {
+			switch field {
+			case "SelectorLeft":
+				d.MoveScaleGuide(-1, 0)
+			case "SelectorRight":
+				d.MoveScaleGuide(1, 0)
+			case "SelectorTop":
+				d.MoveScaleGuide(0, -1)
+			case "SelectorBottom":
+				d.MoveScaleGuide(0, 1)
 			}
 		}
-	} else if field == "OctaveDecreasePressed" {
-		if newValue.(bool) && octaveShift < 3 {
-			octaveShift++
+	} else if field == "ARPPressed" {
+		if newValue.(bool) {
+			d.ToggleSequencer()
 		}
-	} else if field == "OctaveIncreasePressed" {
-		if newValue.(bool) && octaveShift > -3 {
-			octaveShift--
+	} else if field == "PatternPressed" {
+		if newValue.(bool) {
+			if err := d.StartStopSequencer(); err != nil {
+				midiLog.Error("starting the sequencer", "err", err)
+			}
+		}
+	} else if field == "TempoPressed" {
+		if newValue.(bool) {
+			d.Tempo.Tap()
+			inputLog.Info("tempo", "bpm", d.Tempo.BPM())
+		}
+	} else if field == "MetroPressed" {
+		if newValue.(bool) {
+			d.ToggleMetronome()
 		}
 	} else if field == "PlayPressed" {
 		if newValue.(bool) {
-			d.LaunchRickRoll()
+			d.startAction(control, "rickroll")
 		}
 	} else if field == "RecPressed" {
-		d.ColorfulLights(0)
+		if newValue.(bool) {
+			d.StartAnimation("rainbow")
+		}
 	} else {
 		//fmt.Println(field)
 	}
 }
 
+// CurrentScene returns the name of the last scene sent to HA
+func (d *Device) CurrentScene() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.scene
+}
+
+// GetState returns a copy of the last parsed state. The slices in it are never modified in place, so it is safe to keep.
+func (d *Device) GetState() DeviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// ParseDeviceState decodes an input report and runs the callbacks of the controls that changed
 func (d *Device) ParseDeviceState(state []byte) DeviceState {
-	newState := *d.State
+	oldState, newState := d.DecodeDeviceState(state)
+	d.ReflectChanges(reflect.ValueOf(oldState), reflect.ValueOf(newState), d.ChangesCallback)
+	return newState
+}
+
+// DecodeDeviceState updates the state from an input report, and returns the states before and after it
+func (d *Device) DecodeDeviceState(state []byte) (DeviceState, DeviceState) {
+	oldState := d.GetState()
+	newState := oldState
 	if state[0] == 1 {
 		topRowPressed := int(state[1])
 		newState.TopRowButtons = []bool{
@@ -537,7 +613,7 @@ func (d *Device) ParseDeviceState(state []byte) DeviceState {
 				buttonLightsBuffer[TOP_ROW_START+i] = GetColor(Color{RED, 2})
 			}
 		}*/
-		d.Lock()
+		d.mu.Lock()
 		for i := 0; i < 4; i++ {
 			if newState.SelectorTouched {
 				d.CurrentButtonsBuffer[WHEEL_LEFT+i] = GetColor(Color{uint8(newState.SelectorPitch), 2})
@@ -545,9 +621,8 @@ func (d *Device) ParseDeviceState(state []byte) DeviceState {
 				d.CurrentButtonsBuffer[WHEEL_LEFT+i] = d.DefaultButtonsBuffer[WHEEL_LEFT+i]
 			}
 		}
-		d.WriteToDevice(0x80, d.CurrentButtonsBuffer)
-		d.Unlock()
-		// WriteBuffer(d)
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
 
 		newState.MPressed = int(state[4])&1 > 0
 		newState.SPressed = int(state[4])&2 > 0
@@ -596,57 +671,39 @@ func (d *Device) ParseDeviceState(state []byte) DeviceState {
 		newState.RightWheelPitch = (int(state[34])-32)*256 + int(state[33])
 		newState.StripValue = state[37]
 	} else {
-		fmt.Println("Unknown device state", state)
+		hidLog.Warn("unknown device state", "report", fmt.Sprintf("%x", state))
 	}
-	d.ReflectChanges(reflect.ValueOf(*d.State), reflect.ValueOf(newState), d.ChangesCallback)
-	return newState
+	d.mu.Lock()
+	d.state = newState
+	d.mu.Unlock()
+	return oldState, newState
 }
 
 func (d *Device) ReflectChanges(vOld, vNew reflect.Value, callback func(string, int, interface{}, interface{})) {
 	for i := 0; i < vNew.NumField(); i++ {
+		name := vNew.Type().Field(i).Name
 		if vNew.Field(i).Kind() == reflect.Slice || vNew.Field(i).Kind() == reflect.Array {
 			if vOld.Field(i).IsNil() {
-				anyNew := false
 				for j := 0; j < vNew.Field(i).Len(); j++ {
 					if !vNew.Field(i).Index(j).IsZero() {
-						if !anyNew {
-							anyNew = true
-							fmt.Printf("%s: new: ", vNew.Type().Field(i).Name)
-						} else {
-							fmt.Printf(", ")
-						}
-						fmt.Printf("[%d]: %v", j, vNew.Field(i).Index(j))
-						callback(vNew.Type().Field(i).Name, j, nil, vNew.Field(i).Index(j).Interface())
+						inputLog.Debug("new state", "control", name, "index", j, "value", vNew.Field(i).Index(j))
+						callback(name, j, nil, vNew.Field(i).Index(j).Interface())
 					}
 				}
-				if anyNew {
-					fmt.Println()
-				}
 			} else {
-				anyChanges := false
 				for j := 0; j < vNew.Field(i).Len(); j++ {
 					if vNew.Field(i).Index(j).Interface() != vOld.Field(i).Index(j).Interface() { // assumes constant length of arrays once initialized
-						if !anyChanges {
-							anyChanges = true
-							fmt.Printf("%s: ", vNew.Type().Field(i).Name)
-						} else {
-							fmt.Printf(", ")
-						}
-						callback(vNew.Type().Field(i).Name, j, vOld.Field(i).Index(j).Interface(), vNew.Field(i).Index(j).Interface())
-						fmt.Printf("[%d]: %v -> %v", j, vOld.Field(i).Index(j), vNew.Field(i).Index(j))
+						inputLog.Debug("changed", "control", name, "index", j, "old", vOld.Field(i).Index(j), "value", vNew.Field(i).Index(j))
+						callback(name, j, vOld.Field(i).Index(j).Interface(), vNew.Field(i).Index(j).Interface())
 					}
 				}
-				if anyChanges {
-					fmt.Println()
-				}
 			}
 		} else {
 			if vNew.Field(i).Interface() != vOld.Field(i).Interface() {
-				fmt.Printf("%s: %v -> %v\n", vNew.Type().Field(i).Name, vOld.Field(i), vNew.Field(i))
-				callback(vNew.Type().Field(i).Name, 0, vOld.Field(i).Interface(), vNew.Field(i).Interface())
+				inputLog.Debug("changed", "control", name, "old", vOld.Field(i), "value", vNew.Field(i))
+				callback(name, 0, vOld.Field(i).Interface(), vNew.Field(i).Interface())
 			}
 		}
-		vNew.Field(i).Interface()
 	}
 }
 
@@ -698,65 +755,302 @@ func (d *Device) NoteOnCallback(note, channel, velocity uint8) {
 		color = PINK
 	default:
 		color = channel + 1
-		fmt.Println("!!!", channel)
+		midiLog.Debug("note on a channel without a color", "channel", channel)
+	}
+	d.mu.Lock()
+	key := d.noteKey(note)
+	if key >= 0 && key < NB_KEYS {
+		c := GetColor(Color{color, brightness})
+		d.CurrentKeysBuffer[key] = c
+		d.litNotes[note] = litNote{key, c}
 	}
-	d.WriteKeyColor(int(note)+OFFSET+octaveShift*12, GetColor(Color{color, brightness}))
-	fmt.Printf("NoteOn: %d, %d, %d\n", note, channel, velocity)
+	d.mu.Unlock()
+	if key < 0 || key >= NB_KEYS {
+		midiLog.Debug("key out of range", "key", key)
+		return
+	}
+	d.MarkDirty(true, false)
+	midiLog.Debug("NoteOn", "note", note, "channel", channel, "velocity", velocity)
 
 }
 func (d *Device) NoteOffCallback(note, channel uint8) {
 	//ToDo: stacking all the on and off notes so if there are two at the same time but on different channels, we show the playing notes
-	fmt.Printf("NoteOff: %d, %d\n", note, channel)
-	key := int(note) + OFFSET + octaveShift*12
-	if key < 0 {
-		return
+	midiLog.Debug("NoteOff", "note", note, "channel", channel)
+	d.mu.Lock()
+	// the note is cleared where it was lit, even if the transposition changed since
+	key := d.noteKey(note)
+	if lit, ok := d.litNotes[note]; ok {
+		key = lit.key
+		delete(d.litNotes, note)
 	}
-	d.Lock()
-	defaultColor := d.DefaultKeysBuffer[key]
-	d.Unlock()
-	d.WriteKeyColor(key, defaultColor)
+	if key >= 0 && key < NB_KEYS {
+		d.CurrentKeysBuffer[key] = d.DefaultKeysBuffer[key]
+	}
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
 }
 
+// Device is shared by the HID read loop, the MIDI callbacks, animations, the API server and HA goroutines.
+// Everything below mu is guarded by it; the buffers are only ever modified in place.
+// Actions, the bindings, continuous, the scales, the sequencer config and the MIDI outputs are set before any of those start and are read-only afterwards.
+// Only the LED writer goroutine writes LED reports to Device, and only the main loop reads from it.
 type Device struct {
 	Device               *hid.Device
-	State                *DeviceState
+	HA                   *HomeAssistant
+	Actions              map[string]Action
+	Bindings             map[string]string
+	Feedback             map[string]FeedbackConfig
+	Results              ResultsConfig
+	continuous           map[string]*continuousControl
+	scales               []Scale
+	scaleConfig          ScaleGuideConfig
+	scaleIndex           int
+	LearnConfig          LearnConfig
+	NoteBindings         []NoteBinding
+	SequencerConfig      SequencerConfig
+	SequencerOut         writer.ChannelWriter
+	Tempo                Clock
+	TempoConfig          TempoConfig
+	SyncConfig           SyncConfig
+	DAW                  DAWConfig
+	DAWOut               writer.ChannelWriter
+	Events               EventBus
 	DefaultColor         Color
 	DefaultKeysBuffer    []byte
 	DefaultButtonsBuffer []byte
 	CurrentKeysBuffer    []byte
 	CurrentButtonsBuffer []byte
 	PlayingAnimation     bool
-	*sync.Mutex
+	MaxFrameRate         int
+	StateFile            string // where PersistentState is saved; empty disables saving
+	Serial               string // serial number of the keyboard, which tells it apart from others
+	keysDirty            bool
+	buttonsDirty         bool
+	flush                chan struct{}
+	// closed by the LED writer once it wrote what was dirty when they were added, see FlushLEDs
+	flushed []chan struct{}
+	// called with every LED report written, with or without a keyboard
+	onWrite func(where byte, data []byte)
+	actions sync.WaitGroup
+
+	mu            sync.Mutex
+	state         DeviceState
+	showingScenes bool
+	octave        int
+	semitone      int
+	litNotes      map[uint8]litNote
+	scaleGuide    *scaleGuide
+	learn         *learnSession
+	commandMode   bool
+	seq           sequencer
+	animationName string
+	scene         string
+	stopAnimation chan struct{}
+	stopMetronome chan struct{}
+	stopTransport chan struct{}
+	toggled       map[string]bool
+	bindingLights map[string]Color
+	failures      map[string]int
+	saveTimer     *time.Timer
+	// LEDs currently showing a value, see ShowValue
+	valueLEDs       map[int]bool
+	valueGeneration int
 }
 
-func main() {
-	ha = HomeAssistant{
-		Token: haToken,
-		URL:   "http://192.168.1.2:8123/api/",
-	}
-	err := hid.Init()
-	must(err)
-	dHid, err := hid.Open(VENDOR_ID, PRODUCT_ID, SERIAL_NUMBER)
-	must(err)
-	dHid.Write([]byte{0xa0})
-	d := Device{
+func NewDevice(dHid *hid.Device, ha *HomeAssistant) *Device {
+	return &Device{
 		Device:               dHid,
-		State:                &DeviceState{},
+		HA:                   ha,
 		DefaultColor:         Color{},
 		DefaultKeysBuffer:    make([]byte, 249),
 		DefaultButtonsBuffer: make([]byte, 249),
 		CurrentKeysBuffer:    make([]byte, 249),
 		CurrentButtonsBuffer: make([]byte, 249),
-		Mutex:                &sync.Mutex{},
+		MaxFrameRate:         LED_MAX_FPS,
+		litNotes:             make(map[uint8]litNote),
+	}
+}
+
+// setupDevice creates a Device configured with config and starts it; dHid can be nil to run without the keyboard
+func setupDevice(config *Config, dHid *hid.Device) (*Device, error) {
+	d := NewDevice(dHid, &config.HomeAssistant)
+	if err := d.Configure(config); err != nil {
+		return nil, err
+	}
+	d.StateFile = config.StateFile
+	d.Serial = serialNumber
+	if dHid != nil {
+		serial, err := dHid.GetSerialNbr()
+		if err != nil {
+			hidLog.Warn("reading the serial number", "err", err)
+		} else {
+			d.Serial = serial
+		}
+	}
+	d.StartLEDWriter()
+	d.LoadContinuousValues()
+	d.Tempo.Start()
+	return d, nil
+}
+
+// Configure checks config and applies it to a new Device, without starting anything.
+// It returns every problem found, joined.
+func (d *Device) Configure(config *Config) error {
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	check(checkColors(reflect.ValueOf(config).Elem(), ""))
+	if config.LEDMaxFPS < 0 {
+		check(fmt.Errorf("led_max_fps: %d is negative", config.LEDMaxFPS))
+	} else if config.LEDMaxFPS > 0 {
+		d.MaxFrameRate = config.LEDMaxFPS
+	}
+	d.Actions = d.BuiltinActions()
+	for name, action := range config.Actions {
+		d.Actions[name] = action.Action()
+	}
+	kinds := controlKinds()
+	for control, action := range config.Bindings {
+		if kinds[control] != reflect.Bool {
+			check(fmt.Errorf("binding of %s: not a button or a touch", control))
+		}
+		if _, ok := d.Actions[action]; !ok {
+			check(fmt.Errorf("binding of %s: unknown action %q", control, action))
+		}
+	}
+	d.Bindings = config.Bindings
+	check(d.checkBindingLights(config.BindingLights))
+	for control := range config.Continuous {
+		if kind, ok := kinds[control]; !ok || kind == reflect.Bool {
+			check(fmt.Errorf("continuous binding of %s: not a knob, a wheel or the strip", control))
+		}
+	}
+	check(d.SetContinuousBindings(config.Continuous))
+	check(d.SetFeedback(config.Feedback))
+	d.Results = config.Results
+	check(d.SetScaleGuideConfig(config.ScaleGuide))
+	d.LearnConfig = config.Learn
+	check(d.SetNoteBindings(config.NoteBindings))
+	d.SequencerConfig = config.Sequencer
+	check(d.SetTempoConfig(config.Tempo))
+	if config.Sync.Animation != "" {
+		if _, ok := Animations[config.Sync.Animation]; !ok {
+			check(fmt.Errorf("sync: unknown animation %q", config.Sync.Animation))
+		}
+	}
+	d.SyncConfig = config.Sync
+	switch config.DAW.Mode {
+	case "", DAW_MMC, DAW_MCU:
+	default:
+		check(fmt.Errorf("daw: unknown mode %q", config.DAW.Mode))
+	}
+	d.DAW = config.DAW
+	return errors.Join(problems...)
+}
+
+func main() {
+	flag.Usage = usage
+	addGlobalFlags(flag.CommandLine)
+	flag.Parse()
+	must(SetupLogging(LogConfig{JSON: logJSON}, verbose))
+	name, args := "run", []string{}
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	command, ok := Commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := command.Run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// RunCommand runs the keyboard until it is disconnected
+func RunCommand(args []string) error {
+	flags := commandFlags("run")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: run [flags]")
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	d, err := setupDevice(config, dHid)
+	if err != nil {
+		return err
 	}
 	d.LightsOff()
 	defer d.Device.Close()
-	d.WriteAll(Color{RED, 1})
+	saved, err := LoadState(d.StateFile)
+	if err != nil {
+		appLog.Error("loading the state", "err", err)
+	}
+	if saved != nil {
+		d.RestoreState(saved)
+	} else {
+		d.WriteAll(Color{RED, 1})
+	}
+	if err := d.ShowBindingLights(config.BindingLights); err != nil {
+		appLog.Error("lighting the bound controls", "err", err)
+	}
 
 	drv, err := rtmididrv.New()
-	must(err)
+	if err != nil {
+		return err
+	}
 	defer drv.Close()
 
+	// the outputs are opened before anything that sends to them starts: the API, MQTT and the MIDI listeners
+	seqOut, err := OpenMIDIOutput(drv, config.Sequencer.Output, "Komplete Kontrol Sequencer")
+	if err != nil {
+		midiLog.Error("opening the sequencer output", "err", err)
+	} else {
+		defer seqOut.Close()
+		d.SequencerOut = writer.New(seqOut)
+	}
+	if config.Tempo.SendClock {
+		clockOut, err := OpenMIDIOutput(drv, config.Tempo.ClockOutput, "Komplete Kontrol Clock")
+		if err != nil {
+			midiLog.Error("opening the clock output", "err", err)
+		} else {
+			defer clockOut.Close()
+			go d.SendClock(writer.New(clockOut))
+		}
+	}
+	if config.DAW.Mode != "" {
+		dawOut, err := OpenMIDIOutput(drv, config.DAW.Output, "Komplete Kontrol DAW")
+		if err != nil {
+			midiLog.Error("opening the DAW output", "err", err)
+		} else {
+			defer dawOut.Close()
+			d.DAWOut = writer.New(dawOut)
+		}
+	}
+
+	if config.API.Listen != "" {
+		go func() {
+			err := d.ServeAPI(config.API.Listen)
+			appLog.Error("API server stopped", "err", err)
+		}()
+	}
+	if config.MQTT.Broker != "" {
+		_, err := d.StartMQTT(config.MQTT)
+		if err != nil {
+			mqttLog.Error("connecting", "err", err)
+		}
+	}
+
 	/*outs, err := drv.Outs()
 	must(err)
 	ins, err := drv.Ins()
@@ -765,10 +1059,12 @@ func main() {
 	var out midi.Out*/
 	// ToDo: find the LoopBe input by the name substring
 	ins, err := drv.Ins()
-	must(err)
+	if err != nil {
+		return err
+	}
 	var in midi.In
 	for _, o := range ins {
-		fmt.Println(o.String(), o.Number())
+		midiLog.Debug("input", "name", o.String(), "number", o.Number())
 		if strings.Contains(o.String(), "LoopBe Internal MIDI") {
 			//in = o
 			break
@@ -776,15 +1072,13 @@ func main() {
 	}
 	if in == nil {
 		for _, o := range ins {
-			fmt.Println(o.String(), o.Number())
 			if strings.Contains(o.String(), "KOMPLETE KONTROL") {
 				in = o
 			}
 		}
 	}
 	if in == nil {
-		fmt.Println("No input found")
-		return
+		return fmt.Errorf("no keyboard MIDI input found")
 	}
 
 	//in, err = midi.OpenIn(drv, -1, "LoopBe Internal MIDI 3")
@@ -810,7 +1104,44 @@ func main() {
 	//in, err := midi.OpenIn(drv, 0, "Test Golang MIDI Output")
 	//drv.OpenVirtualIn()
 	// must(in.Open())*/
+	if err := in.Open(); err != nil {
+		return err
+	}
 	defer in.Close()
+	go func() {
+		err := d.ListenMIDI(in)
+		if err != nil {
+			midiLog.Error("listening", "port", in.String(), "err", err)
+		}
+	}()
+	if config.DAW.Mode == DAW_MCU {
+		dawIn, err := OpenMIDIInput(drv, config.DAW.Input, "Komplete Kontrol DAW")
+		if err != nil {
+			midiLog.Error("opening the DAW input", "err", err)
+		} else {
+			defer dawIn.Close()
+			go func() {
+				err := d.ListenMCU(dawIn)
+				if err != nil {
+					midiLog.Error("listening", "port", dawIn.String(), "err", err)
+				}
+			}()
+		}
+	}
+	if config.Sync.Input != "" {
+		syncIn, err := OpenMIDIInput(drv, config.Sync.Input, "")
+		if err != nil {
+			midiLog.Error("opening the sync input", "err", err)
+		} else {
+			defer syncIn.Close()
+			go func() {
+				err := d.ListenMIDI(syncIn)
+				if err != nil {
+					midiLog.Error("listening", "port", syncIn.String(), "err", err)
+				}
+			}()
+		}
+	}
 	/*rd := reader.New(
 		reader.NoLogger(),
 		// write every message to the out port
@@ -829,12 +1160,14 @@ func main() {
 	for {
 		buffer := make([]byte, 42)
 		n, err := d.Device.Read(buffer)
-		must(err)
+		if err != nil {
+			return err
+		}
 		if n == 0 {
 			continue
 		}
-		state := d.ParseDeviceState(buffer)
-		d.State = &state
+		hidReads.Inc()
+		d.ParseDeviceState(buffer)
 	}
 }
 
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLEDWritesCoalesce(t *testing.T) {
+	d := NewDevice(nil, &HomeAssistant{})
+	if err := d.Configure(&Config{LEDMaxFPS: 10}); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var writes int
+	var last byte
+	d.onWrite = func(where byte, data []byte) {
+		if where != 0x81 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		writes++
+		last = data[0]
+	}
+	d.StartLEDWriter()
+	// 100 frames in much less than the 100ms between two writes at 10 FPS
+	for i := 1; i <= 100; i++ {
+		d.WriteKeyColor(0, byte(i))
+		d.MarkDirty(true, false)
+	}
+	d.FlushLEDs()
+	mu.Lock()
+	if writes == 0 || writes > 3 {
+		t.Errorf("100 frames were written %d times", writes)
+	}
+	if last != 100 {
+		t.Errorf("the last write sent %d, not the last frame", last)
+	}
+	mu.Unlock()
+	// the next write waits for its turn
+	start := time.Now()
+	d.FlushLEDs()
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("wrote again after %v at 10 FPS", elapsed)
+	}
+}
+
+func TestLEDMaxFPSConfig(t *testing.T) {
+	if err := NewDevice(nil, &HomeAssistant{}).Configure(&Config{LEDMaxFPS: -1}); err == nil {
+		t.Error("negative led_max_fps accepted")
+	}
+	d := NewDevice(nil, &HomeAssistant{})
+	if err := d.Configure(&Config{}); err != nil || d.MaxFrameRate != LED_MAX_FPS {
+		t.Errorf("max frame rate %d without led_max_fps, %v", d.MaxFrameRate, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	hidReads     = newMetric("komplete_kontrol_hid_reports_read_total", "Input reports read from the keyboard.", nil)
+	hidWrites    = newMetric("komplete_kontrol_hid_reports_written_total", "LED reports written to the keyboard, by report.", nil)
+	hidWriteTime = newMetric("komplete_kontrol_hid_write_seconds", "Time to write an LED report to the keyboard.",
+		[]float64{.0005, .001, .002, .005, .01, .02, .05, .1})
+	midiMessages = newMetric("komplete_kontrol_midi_messages_total", "MIDI messages received, by port.", nil)
+	animFrames   = newMetric("komplete_kontrol_animation_frames_total", "LED frames written while an animation plays, by animation.", nil)
+	haCalls      = newMetric("komplete_kontrol_ha_calls_total", "Home Assistant calls, by service and outcome.", nil)
+	haCallTime   = newMetric("komplete_kontrol_ha_call_seconds", "Duration of Home Assistant calls, by service.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+
+	metrics = []*metric{hidReads, hidWrites, hidWriteTime, midiMessages, animFrames, haCalls, haCallTime}
+)
+
+// metric is a counter, or a histogram if it has buckets, with a value per set of labels
+type metric struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	// the counter, or the sum of the observations of a histogram
+	sum    float64
+	count  uint64
+	counts []uint64
+}
+
+func newMetric(name, help string, buckets []float64) *metric {
+	return &metric{name: name, help: help, buckets: buckets, values: make(map[string]*metricValue)}
+}
+
+// value returns the value for labels given as name, value pairs. Called with m.mu held.
+func (m *metric) value(labels []string) *metricValue {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	key := strings.Join(pairs, ",")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{counts: make([]uint64, len(m.buckets))}
+		m.values[key] = v
+	}
+	return v
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Inc adds one to a counter
+func (m *metric) Inc(labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value(labels).sum++
+}
+
+// Observe adds an observation to a histogram
+func (m *metric) Observe(seconds float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.value(labels)
+	v.sum += seconds
+	v.count++
+	for i, le := range m.buckets {
+		if seconds <= le {
+			v.counts[i]++
+		}
+	}
+}
+
+// ObserveSince adds the time since start to a histogram
+func (m *metric) ObserveSince(start time.Time, labels ...string) {
+	m.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// write writes the metric in the Prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kind := "counter"
+	if m.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %v\n", m.name, braces(key), v.sum)
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(joinLabels(key, fmt.Sprintf("le=\"%v\"", le))), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(joinLabels(key, `le="+Inf"`)), v.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", m.name, braces(key), v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, braces(key), v.count)
+	}
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// haService is the label of a Home Assistant API path: the service for service calls, e.g. "light.turn_on", or else the first part of the path
+func haService(path string) string {
+	if rest, ok := strings.CutPrefix(path, "services/"); ok {
+		return strings.Replace(rest, "/", ".", 1)
+	}
+	first, _, _ := strings.Cut(path, "/")
+	return first
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterFormat(t *testing.T) {
+	m := newMetric("test_total", "A counter.", nil)
+	m.Inc("port", `a "quoted"\port`)
+	m.Inc("port", `a "quoted"\port`)
+	m.Inc("port", "b")
+	var b bytes.Buffer
+	m.write(&b)
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{port="a \"quoted\"\\port"} 2
+test_total{port="b"} 1
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHistogramFormat(t *testing.T) {
+	m := newMetric("test_seconds", "A histogram.", []float64{.1, 1})
+	m.Observe(.05)
+	m.Observe(.5)
+	m.Observe(2)
+	var b bytes.Buffer
+	m.write(&b)
+	want := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	m = newMetric("test_seconds", "A histogram.", []float64{1})
+	m.Observe(.5, "service", "light.turn_on")
+	b.Reset()
+	m.write(&b)
+	if !strings.Contains(b.String(), `test_seconds_bucket{service="light.turn_on",le="+Inf"} 1`) {
+		t.Errorf("labels not joined with le:\n%s", b.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	d := newTestDevice()
+	// the call fails, as nothing listens on the HA port
+	d.HA.CallHomeAssistant("services/light/turn_on", http.MethodPost, "{}")
+	api := d.APIHandler()
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatal(rec.Code, rec.Header())
+	}
+	for _, m := range metrics {
+		if !strings.Contains(rec.Body.String(), "# TYPE "+m.name+" ") {
+			t.Error("missing", m.name)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), `komplete_kontrol_ha_calls_total{service="light.turn_on",outcome="error"}`) {
+		t.Errorf("failed HA call not counted:\n%s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error("POST answered with", rec.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/rtmididrv"
+)
+
+// OpenMIDIOutput opens the first output whose name contains name, or a virtual output called virtualName if name is empty
+func OpenMIDIOutput(drv *rtmididrv.Driver, name, virtualName string) (midi.Out, error) {
+	if name == "" {
+		return drv.OpenVirtualOut(virtualName)
+	}
+	outs, err := drv.Outs()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range outs {
+		if strings.Contains(o.String(), name) {
+			return o, o.Open()
+		}
+	}
+	return nil, fmt.Errorf("no MIDI output matching %q", name)
+}
+
+// OpenMIDIInput opens the first input whose name contains name, or a virtual input called virtualName if name is empty
+func OpenMIDIInput(drv *rtmididrv.Driver, name, virtualName string) (midi.In, error) {
+	if name == "" {
+		return drv.OpenVirtualIn(virtualName)
+	}
+	ins, err := drv.Ins()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ins {
+		if strings.Contains(i.String(), name) {
+			return i, i.Open()
+		}
+	}
+	return nil, fmt.Errorf("no MIDI input matching %q", name)
+}
+
+// ListenMIDI handles the notes played on the keyboard, read from its MIDI port, and the clock and transport of a DAW
+func (d *Device) ListenMIDI(in midi.In) error {
+	port := in.String()
+	rd := reader.New(
+		reader.NoLogger(),
+		reader.Each(func(p *reader.Position, msg midi.Message) {
+			midiMessages.Inc("port", port)
+		}),
+		reader.NoteOn(func(p *reader.Position, channel, key, vel uint8) {
+			if vel == 0 {
+				d.PlayedNoteOff(key, channel)
+				return
+			}
+			d.PlayedNoteOn(key, channel, vel)
+		}),
+		reader.NoteOff(func(p *reader.Position, channel, key, vel uint8) {
+			d.PlayedNoteOff(key, channel)
+		}),
+		reader.RTClock(d.Tempo.ExternalTick),
+		reader.RTStart(d.TransportStart),
+		reader.RTContinue(d.TransportContinue),
+		reader.RTStop(d.TransportStop),
+		reader.SPP(func(p *reader.Position, pos uint16) {
+			d.Tempo.SetSongPosition(pos)
+		}),
+	)
+	return rd.ListenTo(in)
+}
+
+func (d *Device) PlayedNoteOn(note, channel, velocity uint8) {
+	if d.commandNoteOn(note, velocity) || d.learnNoteOn(note) {
+		return
+	}
+	d.NoteOnCallback(note, channel, velocity)
+}
+
+func (d *Device) PlayedNoteOff(note, channel uint8) {
+	if d.CommandMode() || d.Learning() {
+		return
+	}
+	d.NoteOffCallback(note, channel)
+}
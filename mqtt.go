@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT topics, relative to MQTTConfig.Topic:
+//
+//	status                  "online"/"offline", retained
+//	event/{control}         every InputEvent as JSON
+//	button/{control}        "press"/"release", used by the HA device triggers
+//	set/key/{key}           {"color": 1, "brightness": 2}
+//	set/button/{button}     {"color": 1, "brightness": 2}
+//	set/fill                {"color": 1, "brightness": 2}
+//	animation/start         animation name
+//	animation/stop          anything
+//	action                  action name
+const (
+	// how long StartMQTT waits for the first connection before leaving it to the retries
+	MQTT_CONNECT_TIMEOUT = 5 * time.Second
+	MQTT_RETRY_INTERVAL  = 10 * time.Second
+)
+
+type MQTTBridge struct {
+	d      *Device
+	config MQTTConfig
+	client mqtt.Client
+}
+
+func (d *Device) StartMQTT(config MQTTConfig) (*MQTTBridge, error) {
+	b := &MQTTBridge{d: d, config: config}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(MQTT_RETRY_INTERVAL).
+		SetWill(b.topic("status"), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect)
+	b.client = mqtt.NewClient(opts)
+	// the token of the first connection completes only once it succeeds, until then the client keeps retrying
+	token := b.client.Connect()
+	if !token.WaitTimeout(MQTT_CONNECT_TIMEOUT) {
+		mqttLog.Warn("broker not reachable yet, retrying in the background", "broker", config.Broker)
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	// subscribed before returning, so that no event is missed
+	go b.publishEvents(d.Events.Subscribe())
+	return b, nil
+}
+
+func (b *MQTTBridge) topic(parts ...string) string {
+	return b.config.Topic + "/" + strings.Join(parts, "/")
+}
+
+// onConnect runs on every (re)connection, as subscriptions and the retained status don't survive a lost session
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	client.Publish(b.topic("status"), 1, true, "online")
+	handlers := map[string]mqtt.MessageHandler{
+		b.topic("set", "key", "+"):    b.handleSetColor,
+		b.topic("set", "button", "+"): b.handleSetColor,
+		b.topic("set", "fill"):        b.handleSetColor,
+		b.topic("animation", "start"): b.handleAnimation,
+		b.topic("animation", "stop"):  b.handleAnimation,
+		b.topic("action"):             b.handleAction,
+	}
+	for topic, handler := range handlers {
+		if token := client.Subscribe(topic, 1, handler); token.Wait() && token.Error() != nil {
+			mqttLog.Error("subscribing", "topic", topic, "err", token.Error())
+		}
+	}
+	if b.config.DiscoveryPrefix != "" {
+		b.publishDiscovery()
+	}
+}
+
+func (b *MQTTBridge) publishEvents(events chan InputEvent) {
+	defer b.d.Events.Unsubscribe(events)
+	for e := range events {
+		id := controlID(e.Control, e.Index)
+		b.client.Publish(b.topic("event", id), 0, false, getJson(e))
+		if pressed, ok := e.Value.(bool); ok && e.Kind == "button" {
+			payload := "release"
+			if pressed {
+				payload = "press"
+			}
+			b.client.Publish(b.topic("button", id), 0, false, payload)
+		}
+	}
+}
+
+func (b *MQTTBridge) handleSetColor(_ mqtt.Client, m mqtt.Message) {
+	var c Color
+	err := json.Unmarshal(m.Payload(), &c)
+	if err == nil {
+		err = c.Check()
+	}
+	if err != nil {
+		mqttLog.Warn("invalid color", "topic", m.Topic(), "err", err)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(m.Topic(), b.topic("set")+"/"), "/")
+	if parts[0] == "fill" {
+		b.d.WriteAll(c)
+		return
+	}
+	i, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		mqttLog.Warn("invalid index", "topic", m.Topic())
+		return
+	}
+	if parts[0] == "key" {
+		b.d.WriteKeyColor(i, GetColor(c))
+	} else {
+		b.d.WriteButtonColor(i, GetColor(c))
+	}
+}
+
+func (b *MQTTBridge) handleAnimation(_ mqtt.Client, m mqtt.Message) {
+	if m.Topic() == b.topic("animation", "stop") {
+		b.d.StopAnimation()
+		return
+	}
+	if err := b.d.StartAnimation(string(m.Payload())); err != nil {
+		mqttLog.Error("starting an animation", "err", err)
+	}
+}
+
+func (b *MQTTBridge) handleAction(_ mqtt.Client, m mqtt.Message) {
+	b.d.RunActionFrom("", string(m.Payload()))
+}
+
+// publishDiscovery announces every button as a press and a release HA device trigger
+func (b *MQTTBridge) publishDiscovery() {
+	device := map[string]interface{}{
+		"identifiers":  []string{"komplete_kontrol_" + b.d.Serial},
+		"name":         "Komplete Kontrol",
+		"manufacturer": "Native Instruments",
+		"model":        "Komplete Kontrol S61 MK2",
+	}
+	nodeID := "komplete_kontrol_" + strings.ToLower(b.d.Serial)
+	for _, id := range buttonControlIDs() {
+		for _, t := range []struct{ payload, triggerType string }{
+			{"press", "button_short_press"},
+			{"release", "button_short_release"},
+		} {
+			config := map[string]interface{}{
+				"automation_type": "trigger",
+				"topic":           b.topic("button", id),
+				"payload":         t.payload,
+				"type":            t.triggerType,
+				"subtype":         id,
+				"device":          device,
+			}
+			topic := strings.Join([]string{b.config.DiscoveryPrefix, "device_automation", nodeID, id + "_" + t.payload, "config"}, "/")
+			b.client.Publish(topic, 1, true, getJson(config))
+		}
+	}
+}
+
+// controlID names a control for topics: the DeviceState field, followed by the 1-based index for rows
+func controlID(field string, i int) string {
+	if f, ok := reflect.TypeOf(DeviceState{}).FieldByName(field); ok && f.Type.Kind() == reflect.Slice {
+		return field + strconv.Itoa(i+1)
+	}
+	return field
+}
+
+// controlKinds maps the ID of every control to the kind of its value: reflect.Bool for buttons and touches,
+// an integer kind for knobs, wheels and the strip
+func controlKinds() map[string]reflect.Kind {
+	kinds := make(map[string]reflect.Kind)
+	t := reflect.TypeOf(DeviceState{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() != reflect.Slice {
+			kinds[f.Name] = f.Type.Kind()
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			kinds[controlID(f.Name, j)] = f.Type.Elem().Kind()
+		}
+	}
+	return kinds
+}
+
+func buttonControlIDs() []string {
+	var ids []string
+	t := reflect.TypeOf(DeviceState{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if controlKind(f.Name) != "button" {
+			continue
+		}
+		switch {
+		case f.Type.Kind() == reflect.Bool:
+			ids = append(ids, f.Name)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Bool:
+			for j := 0; j < 8; j++ {
+				ids = append(ids, controlID(f.Name, j))
+			}
+		}
+	}
+	return ids
+}
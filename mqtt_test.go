@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TestMQTTBridge needs a broker, e.g. MQTT_TEST_BROKER=tcp://127.0.0.1:1883 with mosquitto running
+func TestMQTTBridge(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_TEST_BROKER is not set")
+	}
+	config := MQTTConfig{
+		Broker:          broker,
+		ClientID:        "komplete-kontrol-test",
+		Topic:           "komplete_kontrol_test",
+		DiscoveryPrefix: "komplete_kontrol_test_discovery",
+	}
+	messages := make(chan mqtt.Message, 1000)
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID("komplete-kontrol-test-client")
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	for _, topic := range []string{config.Topic + "/#", config.DiscoveryPrefix + "/#"} {
+		token := client.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) { messages <- m })
+		if token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	// expect waits for a message on topic, skipping the others and those retained from an earlier run
+	expect := func(topic, payload string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case m := <-messages:
+				if m.Topic() != topic || m.Retained() {
+					continue
+				}
+				if payload != "" && string(m.Payload()) != payload {
+					t.Errorf("%s: got %q, want %q", topic, m.Payload(), payload)
+				}
+				return
+			case <-timeout:
+				t.Fatalf("nothing on %s", topic)
+			}
+		}
+	}
+
+	d := newTestDevice()
+	d.Serial = "TEST1234"
+	b, err := d.StartMQTT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Disconnect(0)
+	expect(config.Topic+"/status", "online")
+	expect(config.DiscoveryPrefix+"/device_automation/komplete_kontrol_test1234/PlayPressed_press/config", "")
+
+	// a press of Shift, which does nothing else
+	d.ParseDeviceState(report(map[int]byte{2: 128}))
+	expect(config.Topic+"/button/ShiftPressed", "press")
+
+	// the messages are handled in order, so the invalid color is handled once key 5 is set
+	client.Publish(config.Topic+"/set/key/6", 1, false, `{"color": 70, "brightness": 2}`).Wait()
+	client.Publish(config.Topic+"/set/key/5", 1, false, `{"color": 7, "brightness": 2}`).Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		key := d.CurrentKeysBuffer[5]
+		d.mu.Unlock()
+		if key == GetColor(Color{GREEN, 2}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key 5 not set")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.mu.Lock()
+	invalid := d.CurrentKeysBuffer[6]
+	d.mu.Unlock()
+	if invalid != 0 {
+		t.Error("invalid color set")
+	}
+}
+
+func TestMQTTBrokerDown(t *testing.T) {
+	d := newTestDevice()
+	// nothing listens on the discard port
+	b, err := d.StartMQTT(MQTTConfig{Broker: "tcp://127.0.0.1:9", ClientID: "komplete-kontrol-test", Topic: "komplete_kontrol_test"})
+	if err != nil {
+		t.Fatal("gave up on the broker:", err)
+	}
+	b.client.Disconnect(0)
+}
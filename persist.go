@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// changes are written at most once per STATE_SAVE_DELAY
+const STATE_SAVE_DELAY = time.Second
+
+// PersistentState is what survives a restart
+type PersistentState struct {
+	Scene          string `json:"scene"`
+	DefaultKeys    []byte `json:"default_keys"`
+	DefaultButtons []byte `json:"default_buttons"`
+	Octave         int    `json:"octave"`
+	Semitone       int    `json:"semitone"`
+}
+
+// LoadState returns nil if there is no saved state yet
+func LoadState(path string) (*PersistentState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s PersistentState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// RestoreState applies a loaded state and shows the restored defaults
+func (d *Device) RestoreState(s *PersistentState) {
+	d.mu.Lock()
+	d.scene = s.Scene
+	d.octave = clamp(s.Octave, -MAX_OCTAVE_SHIFT, MAX_OCTAVE_SHIFT)
+	d.semitone = clamp(s.Semitone, -MAX_SEMITONE_SHIFT, MAX_SEMITONE_SHIFT)
+	d.showTransposition()
+	copy(d.DefaultKeysBuffer, s.DefaultKeys)
+	copy(d.DefaultButtonsBuffer, s.DefaultButtons)
+	d.mu.Unlock()
+	d.RestoreDefaults()
+}
+
+// saveStateLater schedules the state to be written to StateFile
+func (d *Device) saveStateLater() {
+	if d.StateFile == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.saveTimer == nil {
+		d.saveTimer = time.AfterFunc(STATE_SAVE_DELAY, d.saveState)
+	}
+}
+
+func (d *Device) saveState() {
+	d.mu.Lock()
+	d.saveTimer = nil
+	defaultKeys := d.DefaultKeysBuffer
+	if d.scaleGuide != nil {
+		defaultKeys = d.scaleGuide.savedKeys
+	}
+	s := PersistentState{
+		Scene:          d.scene,
+		DefaultKeys:    append([]byte(nil), defaultKeys...),
+		DefaultButtons: append([]byte(nil), d.DefaultButtonsBuffer...),
+		Octave:         d.octave,
+		Semitone:       d.semitone,
+	}
+	d.mu.Unlock()
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = writeFileAtomic(d.StateFile, data)
+	}
+	if err != nil {
+		appLog.Error("saving the state", "err", err)
+	}
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it over path,
+// so that a crash never leaves a half-written file behind
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	d := newTestDevice()
+	d.WriteAll(Color{GREEN, 2})
+	d.SetCurrentKeysAsDefault()
+	d.SetCurrentButtonsAsDefault()
+	d.Transpose(-1, 2)
+	d.mu.Lock()
+	d.scene = "green"
+	d.mu.Unlock()
+	d.StateFile = path
+	d.saveState()
+
+	s, err := LoadState(path)
+	if err != nil || s == nil {
+		t.Fatal(s, err)
+	}
+	if s.Scene != "green" || s.Octave != -1 || s.Semitone != 2 {
+		t.Errorf("loaded %+v", s)
+	}
+	restored := newTestDevice()
+	restored.RestoreState(s)
+	if restored.DefaultKeysBuffer[0] != GetColor(Color{GREEN, 2}) || restored.CurrentScene() != "green" {
+		t.Error("defaults or scene not restored")
+	}
+	if octave, semitone := restored.Transposition(); octave != -1 || semitone != 2 {
+		t.Errorf("transposition restored as %d, %d", octave, semitone)
+	}
+}
+
+func TestLoadMissingState(t *testing.T) {
+	s, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if s != nil || err != nil {
+		t.Error(s, err)
+	}
+}
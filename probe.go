@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// LayoutProfile is what ProbeCommand found out about the LEDs of a keyboard
+type LayoutProfile struct {
+	Model string `json:"model"`
+	// index in the 0x80 report -> name of the LED that lit up
+	Buttons map[int]string `json:"buttons"`
+	// index in the 0x81 report -> name of the LED that lit up
+	Keys map[int]string `json:"keys"`
+	// color value -> name of the color it shows
+	Palette map[int]string `json:"palette"`
+}
+
+// the size of the 0x80 and 0x81 reports
+const LED_REPORT_SIZE = 249
+
+// ProbeCommand lights the LEDs one at a time and asks which one lit up, then writes a LayoutProfile
+func ProbeCommand(args []string) error {
+	flags := commandFlags("probe")
+	output := flags.String("o", "layout.json", "file to write the profile to")
+	model := flags.String("model", "", "name of the keyboard model")
+	buttons := flags.Int("buttons", NB_BUTTONS, "number of 0x80 indices to probe")
+	keys := flags.Int("keys", NB_KEYS, "number of 0x81 indices to probe")
+	palette := flags.Int("palette", 128, "number of color values to probe")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: probe [flags]")
+	}
+
+	dHid, err := OpenKeyboard()
+	if err != nil {
+		return err
+	}
+	defer dHid.Close()
+
+	profile := LayoutProfile{Model: *model}
+	input := bufio.NewScanner(os.Stdin)
+	fmt.Println("Name what lights up; enter for nothing, s to skip the rest of a report, q to save and quit")
+	fmt.Println("Name the LEDs of buttons after their control, e.g. PlayPressed or TopRowButtons1, so that the layout can be used")
+
+	quit := false
+	// probe shows each of the n steps with show and records the answers, until s or q
+	probe := func(n int, prompt string, show func(i int)) map[int]string {
+		found := make(map[int]string)
+		for i := 0; i < n && !quit; i++ {
+			show(i)
+			fmt.Printf(prompt, i)
+			answer := "q"
+			if input.Scan() {
+				answer = strings.TrimSpace(input.Text())
+			}
+			if answer == "q" {
+				quit = true
+			}
+			if answer == "s" || answer == "q" {
+				break
+			}
+			if answer != "" {
+				found[i] = answer
+			}
+		}
+		return found
+	}
+	lit := GetColor(Color{WHITE, 3})
+	lightOne := func(report byte) func(i int) {
+		return func(i int) {
+			buffer := make([]byte, LED_REPORT_SIZE)
+			buffer[i] = lit
+			dHid.Write(bytesConc([]byte{report}, buffer))
+		}
+	}
+	off := make([]byte, LED_REPORT_SIZE)
+
+	profile.Buttons = probe(clamp(*buttons, 0, LED_REPORT_SIZE), "0x80 index %d: ", lightOne(0x80))
+	dHid.Write(bytesConc([]byte{0x80}, off))
+	profile.Keys = probe(clamp(*keys, 0, LED_REPORT_SIZE), "0x81 index %d: ", lightOne(0x81))
+	profile.Palette = probe(*palette, "color %d: ", func(value int) {
+		buffer := make([]byte, LED_REPORT_SIZE)
+		for i := 0; i < NB_KEYS; i++ {
+			buffer[i] = byte(value)
+		}
+		dHid.Write(bytesConc([]byte{0x81}, buffer))
+	})
+	dHid.Write(bytesConc([]byte{0x81}, off))
+
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*output, data); err != nil {
+		return err
+	}
+	fmt.Println("Saved", *output)
+	return nil
+}
+
+// LoadLayoutProfile returns nil if there is no profile
+func LoadLayoutProfile(path string) (*LayoutProfile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p LayoutProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Apply sets ControlLEDs from the LEDs of the profile named after a button control, and the regions made of them.
+// A guessed LED the profile gives to another control is dropped. Other names, e.g. of the strip LEDs, are only
+// there for people to read.
+func (p *LayoutProfile) Apply() {
+	controls := make(map[string]bool)
+	for _, id := range buttonControlIDs() {
+		controls[id] = true
+	}
+	for i, name := range p.Buttons {
+		if !controls[name] || i < 0 || i >= NB_BUTTONS {
+			hidLog.Debug("LED of the layout not used", "index", i, "name", name)
+			continue
+		}
+		for control, led := range ControlLEDs {
+			if led == i && control != name {
+				delete(ControlLEDs, control)
+			}
+		}
+		ControlLEDs[name] = i
+	}
+	transport := make([]int, len(transportControls))
+	for i, control := range transportControls {
+		transport[i] = ledOf(control)
+	}
+	Regions["transport"] = transport
+	hidLog.Info("loaded the layout", "model", p.Model)
+}
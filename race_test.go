@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+)
+
+// newTestDevice returns a running Device without a keyboard, whose HA calls fail at once
+func newTestDevice() *Device {
+	d := NewDevice(nil, &HomeAssistant{URL: "http://127.0.0.1:1/api/"})
+	d.Actions = d.BuiltinActions()
+	d.StartLEDWriter()
+	d.Tempo.SetBPM(MAX_BPM)
+	d.Tempo.Start()
+	return d
+}
+
+// report returns an input report with the given bytes set
+func report(bytes map[int]byte) []byte {
+	r := make([]byte, 42)
+	r[0] = 1
+	for i, b := range bytes {
+		r[i] = b
+	}
+	return r
+}
+
+// discardWriter is a MIDI output dropping what is written to it
+type discardWriter struct {
+	channel uint8
+}
+
+func (w *discardWriter) Write(midi.Message) error { return nil }
+func (w *discardWriter) Channel() uint8           { return w.channel }
+func (w *discardWriter) SetChannel(ch uint8)      { w.channel = ch }
+
+// within fails the test if f doesn't return within timeout, e.g. because of a deadlock
+func within(t *testing.T, timeout time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("still running after", timeout)
+	}
+}
+
+// TestConcurrentUse runs what the HID loop, the MIDI callbacks, animations and the API do at the same time; run it with -race
+func TestConcurrentUse(t *testing.T) {
+	d := newTestDevice()
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		note := uint8(36 + i%61)
+		d.NoteOnCallback(note, uint8(i%16), 100)
+		d.NoteOffCallback(note, uint8(i%16))
+	})
+	run(func(i int) {
+		// the selector and the octave buttons
+		d.ParseDeviceState(report(map[int]byte{6: byte(i%2) * 4, 8: byte(i % 3), 30: byte(i)}))
+	})
+	run(func(i int) {
+		if i%2 == 0 {
+			d.StartAnimation("rainbow")
+		} else {
+			d.StopAnimation()
+		}
+	})
+	run(func(i int) {
+		d.WriteKeyColor(i%NB_KEYS, GetColor(Color{RED, 1}))
+		d.MarkDirty(true, true)
+		_ = d.GetState()
+		_ = d.CurrentAnimation()
+	})
+	within(t, 10*time.Second, wg.Wait)
+	d.StopAnimation()
+	d.FlushLEDs()
+}
+
+func TestSequencerStartStop(t *testing.T) {
+	d := newTestDevice()
+	d.SequencerOut = &discardWriter{}
+	within(t, 2*time.Second, func() {
+		// Pattern pressed, released and pressed again: the sequencer starts and stops on the HID loop
+		for _, pattern := range []byte{8, 0, 8} {
+			d.ParseDeviceState(report(map[int]byte{4: pattern}))
+		}
+	})
+	d.mu.Lock()
+	running := d.seq.stop != nil
+	d.mu.Unlock()
+	if running {
+		t.Error("the sequencer is still running")
+	}
+}
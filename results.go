@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type ResultsConfig struct {
+	// create a persistent notification in Home Assistant when an action fails
+	Notify bool `json:"notify"`
+}
+
+// RunActionFrom runs an action triggered by control, empty if there is none, and reports its result
+func (d *Device) RunActionFrom(control, name string) error {
+	err := d.RunAction(name)
+	d.reportResult(control, name, err)
+	return err
+}
+
+// startAction runs an action triggered by control in the background, see WaitActions
+func (d *Device) startAction(control, name string) {
+	d.actions.Add(1)
+	go func() {
+		defer d.actions.Done()
+		d.RunActionFrom(control, name)
+	}()
+}
+
+// WaitActions waits for the actions started by the controls and the notes to finish
+func (d *Device) WaitActions() {
+	d.actions.Wait()
+}
+
+// reportResult counts a failure of what, flashes control red and notifies Home Assistant if configured.
+// A success flashes control green if its feedback is "result".
+func (d *Device) reportResult(control, what string, err error) {
+	if control != "" {
+		d.resultFeedback(control, err)
+	}
+	if err == nil {
+		return
+	}
+	appLog.Error("failed", "action", what, "control", control, "err", err)
+	d.mu.Lock()
+	if d.failures == nil {
+		d.failures = make(map[string]int)
+	}
+	d.failures[what]++
+	d.mu.Unlock()
+	if d.Results.Notify {
+		go func() {
+			err := d.HA.CallService("persistent_notification.create", map[string]string{
+				"title":           "Komplete Kontrol",
+				"message":         fmt.Sprintf("%s failed at %s: %v", what, time.Now().Format("15:04:05"), err),
+				"notification_id": "komplete_kontrol_" + what,
+			})
+			if err != nil {
+				haLog.Error("sending the notification", "err", err)
+			}
+		}()
+	}
+}
+
+// Failures returns how many times each action failed
+func (d *Device) Failures() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	failures := make(map[string]int, len(d.failures))
+	for what, n := range d.failures {
+		failures[what] = n
+	}
+	return failures
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type Scale struct {
+	Name      string
+	Intervals []int
+}
+
+var Scales = []Scale{
+	{"major", []int{0, 2, 4, 5, 7, 9, 11}},
+	{"minor", []int{0, 2, 3, 5, 7, 8, 10}},
+	{"harmonic_minor", []int{0, 2, 3, 5, 7, 8, 11}},
+	{"dorian", []int{0, 2, 3, 5, 7, 9, 10}},
+	{"phrygian", []int{0, 1, 3, 5, 7, 8, 10}},
+	{"lydian", []int{0, 2, 4, 6, 7, 9, 11}},
+	{"mixolydian", []int{0, 2, 4, 5, 7, 9, 10}},
+	{"locrian", []int{0, 1, 3, 5, 6, 8, 10}},
+	{"major_pentatonic", []int{0, 2, 4, 7, 9}},
+	{"minor_pentatonic", []int{0, 3, 5, 7, 10}},
+	{"blues", []int{0, 3, 5, 6, 7, 10}},
+}
+
+var NoteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+type ScaleGuideConfig struct {
+	// 0 is C
+	Root      int    `json:"root"`
+	Scale     string `json:"scale"`
+	Color     Color  `json:"color"`
+	RootColor Color  `json:"root_color"`
+	// extra scales, name -> semitones from the root
+	Custom map[string][]int `json:"custom"`
+}
+
+type scaleGuide struct {
+	root  int
+	scale int
+	// default keys to go back to when the guide is turned off
+	savedKeys []byte
+}
+
+func (d *Device) SetScaleGuideConfig(c ScaleGuideConfig) error {
+	scales := append([]Scale(nil), Scales...)
+	var names []string
+	for name := range c.Custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		scales = append(scales, Scale{name, c.Custom[name]})
+	}
+	d.scales = scales
+	d.scaleConfig = c
+	d.scaleConfig.Root = ((c.Root % 12) + 12) % 12
+	for i, s := range scales {
+		if s.Name == c.Scale {
+			d.scaleIndex = i
+			return nil
+		}
+	}
+	if c.Scale != "" {
+		return fmt.Errorf("unknown scale %q", c.Scale)
+	}
+	return nil
+}
+
+// ToggleScaleGuide turns on or off the lighting of the keys in the selected scale
+func (d *Device) ToggleScaleGuide() {
+	d.mu.Lock()
+	if d.scaleGuide != nil {
+		copy(d.DefaultKeysBuffer, d.scaleGuide.savedKeys)
+		d.scaleGuide = nil
+		d.restoreKeysLocked()
+		d.mu.Unlock()
+		d.MarkDirty(true, false)
+		return
+	}
+	d.scaleGuide = &scaleGuide{
+		root:      d.scaleConfig.Root,
+		scale:     d.scaleIndex,
+		savedKeys: append([]byte(nil), d.DefaultKeysBuffer...),
+	}
+	d.renderScaleGuide()
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+}
+
+func (d *Device) ScaleGuideActive() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.scaleGuide != nil
+}
+
+// MoveScaleGuide moves the root by rootStep semitones and the scale by scaleStep in the list of scales
+func (d *Device) MoveScaleGuide(rootStep, scaleStep int) {
+	d.mu.Lock()
+	if d.scaleGuide == nil {
+		d.mu.Unlock()
+		return
+	}
+	g := d.scaleGuide
+	g.root = ((g.root+rootStep)%12 + 12) % 12
+	g.scale = ((g.scale+scaleStep)%len(d.scales) + len(d.scales)) % len(d.scales)
+	inputLog.Info("scale guide", "root", NoteNames[g.root], "scale", d.scales[g.scale].Name)
+	d.renderScaleGuide()
+	d.mu.Unlock()
+	d.MarkDirty(true, false)
+}
+
+// renderScaleGuide makes the scale the default color of the keys and shows it. Called with d.mu held.
+func (d *Device) renderScaleGuide() {
+	g := d.scaleGuide
+	if g == nil {
+		return
+	}
+	inScale := make([]bool, 12)
+	for _, interval := range d.scales[g.scale].Intervals {
+		inScale[((g.root+interval)%12+12)%12] = true
+	}
+	for key := 0; key < NB_KEYS; key++ {
+		// the pitch the key plays with the current transposition
+		pitchClass := ((key-OFFSET+d.octave*12+d.semitone)%12 + 12) % 12
+		switch {
+		case pitchClass == g.root:
+			d.DefaultKeysBuffer[key] = GetColor(d.scaleConfig.RootColor)
+		case inScale[pitchClass]:
+			d.DefaultKeysBuffer[key] = GetColor(d.scaleConfig.Color)
+		default:
+			d.DefaultKeysBuffer[key] = GetColor(Color{BLACK, 0})
+		}
+	}
+	d.restoreKeysLocked()
+}
+
+// restoreKeysLocked shows the default key colors except for the keys lit by playing notes. Called with d.mu held.
+func (d *Device) restoreKeysLocked() {
+	lit := make(map[int]bool)
+	for _, n := range d.litNotes {
+		lit[n.key] = true
+	}
+	for key := 0; key < NB_KEYS; key++ {
+		if !lit[key] {
+			d.CurrentKeysBuffer[key] = d.DefaultKeysBuffer[key]
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+
+	"gitlab.com/gomidi/midi/writer"
+)
+
+const SEQUENCER_STEPS = 8
+
+type SequencerConfig struct {
+	// substring of the MIDI output port name; empty opens a virtual port
+	Output  string `json:"output"`
+	Channel uint8  `json:"channel"`
+	// note of each step; steps past the end use the last note
+	Notes    []uint8 `json:"notes"`
+	Velocity uint8   `json:"velocity"`
+	// steps per quarter note; default 4
+	Division int `json:"division"`
+}
+
+type sequencer struct {
+	steps   [SEQUENCER_STEPS]bool
+	pos     int
+	editing bool
+	stop    chan struct{}
+}
+
+var (
+	SequencerStepColor    = Color{GREEN, 1}
+	SequencerPlayingColor = Color{WHITE, 2}
+)
+
+// ToggleSequencer switches the top row between its usual use and editing the steps
+func (d *Device) ToggleSequencer() {
+	d.mu.Lock()
+	d.seq.editing = !d.seq.editing
+	if d.seq.editing {
+		d.showSequencer()
+	} else {
+		for i := 0; i < SEQUENCER_STEPS; i++ {
+			d.CurrentButtonsBuffer[TOP_ROW_START+i] = d.DefaultButtonsBuffer[TOP_ROW_START+i]
+		}
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+}
+
+func (d *Device) SequencerEditing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq.editing
+}
+
+func (d *Device) ToggleStep(step int) {
+	if step < 0 || step >= SEQUENCER_STEPS {
+		return
+	}
+	d.mu.Lock()
+	d.seq.steps[step] = !d.seq.steps[step]
+	d.showSequencer()
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+}
+
+// showSequencer lights the active steps and the one playing, if the steps are being edited. Called with d.mu held.
+func (d *Device) showSequencer() {
+	if !d.seq.editing {
+		return
+	}
+	for i, on := range d.seq.steps {
+		c := Color{BLACK, 0}
+		switch {
+		case d.seq.stop != nil && i == d.seq.pos:
+			c = SequencerPlayingColor
+		case on:
+			c = SequencerStepColor
+		}
+		d.CurrentButtonsBuffer[TOP_ROW_START+i] = GetColor(c)
+	}
+}
+
+// StartStopSequencer starts playing the steps to the sequencer output, or stops
+func (d *Device) StartStopSequencer() error {
+	d.mu.Lock()
+	if d.seq.stop != nil {
+		close(d.seq.stop)
+		d.seq.stop = nil
+		d.showSequencer()
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
+		return nil
+	}
+	defer d.mu.Unlock()
+	if d.SequencerOut == nil {
+		return fmt.Errorf("no sequencer output")
+	}
+	stop := make(chan struct{})
+	d.seq.stop = stop
+	d.seq.pos = -1
+	go d.runSequencer(stop)
+	return nil
+}
+
+func (d *Device) runSequencer(stop chan struct{}) {
+	c := d.SequencerConfig
+	division := c.Division
+	if division <= 0 {
+		division = 4
+	}
+	if c.Velocity == 0 {
+		c.Velocity = 100
+	}
+	ticksPerStep := uint64(PPQN / division)
+	if ticksPerStep == 0 {
+		ticksPerStep = 1
+	}
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	playing := -1
+	defer func() {
+		if playing >= 0 {
+			if err := writer.NoteOff(d.SequencerOut, uint8(playing)); err != nil {
+				midiLog.Error("sending a note", "err", err)
+			}
+		}
+	}()
+	for {
+		var tick uint64
+		select {
+		case <-stop:
+			return
+		case tick = <-ticks:
+		}
+		// notes last half a step
+		if playing >= 0 && (tick%ticksPerStep == ticksPerStep/2 || tick%ticksPerStep == 0) {
+			if err := writer.NoteOff(d.SequencerOut, uint8(playing)); err != nil {
+				midiLog.Error("sending a note", "err", err)
+			}
+			playing = -1
+		}
+		if tick%ticksPerStep != 0 {
+			continue
+		}
+
+		d.mu.Lock()
+		d.seq.pos = (d.seq.pos + 1) % SEQUENCER_STEPS
+		pos, on := d.seq.pos, d.seq.steps[d.seq.pos]
+		d.showSequencer()
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
+		if !on {
+			continue
+		}
+		note := uint8(36)
+		if len(c.Notes) > 0 {
+			note = c.Notes[len(c.Notes)-1]
+			if pos < len(c.Notes) {
+				note = c.Notes[pos]
+			}
+		}
+		d.SequencerOut.SetChannel(c.Channel)
+		if err := writer.NoteOn(d.SequencerOut, note, c.Velocity); err != nil {
+			midiLog.Error("sending a note", "err", err)
+		}
+		playing = int(note)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/gomidi/midi/writer"
+)
+
+const (
+	MIN_BPM     = 20
+	MAX_BPM     = 300
+	DEFAULT_BPM = 120
+	// ticks per quarter note, as in MIDI clock
+	PPQN = 24
+	// taps further apart than this start a new tap tempo measurement
+	TAP_TIMEOUT = 2 * time.Second
+	MAX_TAPS    = 5
+	// the clock runs on its own again when no MIDI clock was received for this long
+	EXTERNAL_CLOCK_TIMEOUT = 500 * time.Millisecond
+)
+
+type TempoConfig struct {
+	BPM float64 `json:"bpm"`
+	// send MIDI clock to ClockOutput (a substring of the port name), or to a virtual port if it is empty
+	SendClock   bool   `json:"send_clock"`
+	ClockOutput string `json:"clock_output"`
+	// button LED blinking with the metronome, which Metro turns on and off
+	MetronomeLED   int   `json:"metronome_led"`
+	MetronomeColor Color `json:"metronome_color"`
+	AccentColor    Color `json:"accent_color"`
+	BeatsPerBar    int   `json:"beats_per_bar"`
+	// the right wheel nudges the tempo, unless it is bound to something else
+	WheelNudge bool `json:"wheel_nudge"`
+}
+
+// SetTempoConfig sets up the metronome and the starting tempo
+func (d *Device) SetTempoConfig(c TempoConfig) error {
+	if c.MetronomeLED < 0 || c.MetronomeLED >= NB_BUTTONS {
+		return fmt.Errorf("tempo: metronome_led must be between 0 and %d", NB_BUTTONS-1)
+	}
+	if c.BeatsPerBar < 0 {
+		return fmt.Errorf("tempo: beats_per_bar can't be negative")
+	}
+	d.TempoConfig = c
+	if c.BPM > 0 {
+		d.Tempo.SetBPM(c.BPM)
+	}
+	return nil
+}
+
+// Clock is the shared tempo. Once started, it sends the number of each tick (PPQN per beat) to its subscribers.
+// It follows the MIDI clock given to ExternalTick while there is one.
+type Clock struct {
+	mu          sync.Mutex
+	bpm         float64
+	taps        []time.Time
+	tick        uint64
+	reset       bool
+	nextTick    uint64
+	started     bool
+	subscribers map[chan uint64]struct{}
+	// last ticks received from a MIDI clock
+	external []time.Time
+	playing  bool
+	resume   uint64
+	// a DAW sent start, stop or continue
+	transport bool
+}
+
+func (c *Clock) BPM() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bpm == 0 {
+		return DEFAULT_BPM
+	}
+	return c.bpm
+}
+
+func (c *Clock) SetBPM(bpm float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bpm = clampBPM(bpm)
+}
+
+// Nudge changes the tempo by delta BPM
+func (c *Clock) Nudge(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bpm == 0 {
+		c.bpm = DEFAULT_BPM
+	}
+	c.bpm = clampBPM(c.bpm + delta)
+}
+
+// Tap sets the tempo from the average interval between the last taps
+func (c *Clock) Tap() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.taps) > 0 && now.Sub(c.taps[len(c.taps)-1]) > TAP_TIMEOUT {
+		c.taps = nil
+	}
+	c.taps = append(c.taps, now)
+	if len(c.taps) > MAX_TAPS {
+		c.taps = c.taps[1:]
+	}
+	if len(c.taps) < 2 {
+		return
+	}
+	interval := c.taps[len(c.taps)-1].Sub(c.taps[0]) / time.Duration(len(c.taps)-1)
+	c.bpm = clampBPM(float64(time.Minute) / float64(interval))
+	// the last tap is a downbeat
+	c.reset, c.nextTick = true, 0
+}
+
+// Beat returns the duration of a quarter note
+func (c *Clock) Beat() time.Duration {
+	return time.Duration(float64(time.Minute) / c.BPM())
+}
+
+// Restart makes the next tick tick 0, the start of a beat
+func (c *Clock) Restart() {
+	c.SetPosition(0)
+}
+
+// SetPosition sets the number of the next tick
+func (c *Clock) SetPosition(tick uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset, c.nextTick = true, tick
+	c.resume = tick
+}
+
+func (c *Clock) Subscribe() chan uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan uint64]struct{})
+	}
+	ch := make(chan uint64, PPQN)
+	c.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (c *Clock) Unsubscribe(ch chan uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscribers, ch)
+}
+
+// Start starts ticking, if it hasn't already
+func (c *Clock) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return
+	}
+	c.started = true
+	go c.run()
+}
+
+func (c *Clock) run() {
+	next := time.Now()
+	for {
+		next = next.Add(c.Beat() / PPQN)
+		time.Sleep(time.Until(next))
+		c.mu.Lock()
+		if c.followingExternal() {
+			next = time.Now()
+			c.mu.Unlock()
+			continue
+		}
+		if c.reset {
+			next = time.Now()
+		}
+		c.advance()
+		c.mu.Unlock()
+	}
+}
+
+// advance sends the next tick to the subscribers. Called with c.mu held.
+func (c *Clock) advance() {
+	if c.reset {
+		c.reset = false
+		c.tick = c.nextTick
+	} else {
+		c.tick++
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- c.tick:
+		default:
+		}
+	}
+}
+
+// ExternalTick is called on every MIDI timing clock message; the tempo is averaged over the last beat
+func (c *Clock) ExternalTick() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.followingExternal() {
+		c.external = nil
+	}
+	c.external = append(c.external, now)
+	if len(c.external) > PPQN+1 {
+		c.external = c.external[1:]
+	}
+	if n := len(c.external); n > 1 {
+		interval := c.external[n-1].Sub(c.external[0]) / time.Duration(n-1)
+		c.bpm = clampBPM(float64(time.Minute) / float64(interval*PPQN))
+	}
+	c.advance()
+}
+
+// External reports whether the clock follows a MIDI clock
+func (c *Clock) External() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.followingExternal()
+}
+
+// Called with c.mu held
+func (c *Clock) followingExternal() bool {
+	return len(c.external) > 0 && time.Since(c.external[len(c.external)-1]) < EXTERNAL_CLOCK_TIMEOUT
+}
+
+// TransportStart handles a MIDI start: playing from the beginning, with the next tick
+func (c *Clock) TransportStart() {
+	c.SetPosition(0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.playing, c.transport = true, true
+}
+
+// TransportContinue handles a MIDI continue: playing from where it stopped, or from the last song position
+func (c *Clock) TransportContinue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset, c.nextTick = true, c.resume
+	c.playing, c.transport = true, true
+}
+
+func (c *Clock) TransportStop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.playing {
+		c.resume = c.tick + 1
+	}
+	c.playing, c.transport = false, true
+}
+
+// SetSongPosition handles a MIDI song position pointer, in sixteenth notes
+func (c *Clock) SetSongPosition(sixteenths uint16) {
+	c.SetPosition(uint64(sixteenths) * PPQN / 4)
+}
+
+func (c *Clock) Playing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.playing
+}
+
+// Running reports whether what follows the clock should move: always on the clock's own tempo,
+// but only while playing once a DAW has sent its transport
+func (c *Clock) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.transport || c.playing
+}
+
+func clampBPM(bpm float64) float64 {
+	if bpm < MIN_BPM {
+		return MIN_BPM
+	}
+	if bpm > MAX_BPM {
+		return MAX_BPM
+	}
+	return bpm
+}
+
+// SendClock sends a MIDI timing clock message on every tick
+func (d *Device) SendClock(w writer.ChannelWriter) {
+	ticks := d.Tempo.Subscribe()
+	for range ticks {
+		if err := writer.RTClock(w); err != nil {
+			midiLog.Error("sending MIDI clock", "err", err)
+		}
+	}
+}
+
+// ToggleMetronome blinks the metronome LED on every beat, or stops
+func (d *Device) ToggleMetronome() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopMetronome != nil {
+		close(d.stopMetronome)
+		d.stopMetronome = nil
+		return
+	}
+	stop := make(chan struct{})
+	d.stopMetronome = stop
+	go d.runMetronome(stop)
+}
+
+func (d *Device) runMetronome(stop chan struct{}) {
+	c := d.TempoConfig
+	led := c.MetronomeLED
+	beatsPerBar := uint64(c.BeatsPerBar)
+	if beatsPerBar == 0 {
+		beatsPerBar = 4
+	}
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	defer func() {
+		d.mu.Lock()
+		d.CurrentButtonsBuffer[led] = d.DefaultButtonsBuffer[led]
+		d.mu.Unlock()
+		d.MarkDirty(false, true)
+	}()
+	for {
+		var tick uint64
+		select {
+		case <-stop:
+			return
+		case tick = <-ticks:
+		}
+		switch {
+		case tick%(PPQN*beatsPerBar) == 0:
+			d.WriteButtonColor(led, GetColor(c.AccentColor))
+		case tick%PPQN == 0:
+			d.WriteButtonColor(led, GetColor(c.MetronomeColor))
+		case tick%PPQN == PPQN/4:
+			d.mu.Lock()
+			d.CurrentButtonsBuffer[led] = d.DefaultButtonsBuffer[led]
+			d.mu.Unlock()
+			d.MarkDirty(false, true)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockTempo(t *testing.T) {
+	d := newTestDevice()
+	d.Tempo.SetBPM(300)
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	<-ticks
+	start := time.Now()
+	for i := 0; i < 2*PPQN; i++ {
+		<-ticks
+	}
+	// two beats at 300 BPM
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("two beats took %v", elapsed)
+	}
+}
+
+func TestTapTempo(t *testing.T) {
+	var c Clock
+	for i := 0; i < 3; i++ {
+		c.Tap()
+		time.Sleep(250 * time.Millisecond)
+	}
+	if bpm := c.BPM(); bpm < 220 || bpm > 245 {
+		t.Errorf("taps every 250ms gave %v BPM", bpm)
+	}
+	c.SetBPM(1000)
+	if bpm := c.BPM(); bpm != MAX_BPM {
+		t.Errorf("got %v BPM, want at most %v", bpm, MAX_BPM)
+	}
+}
+
+func TestExternalClock(t *testing.T) {
+	d := newTestDevice()
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	d.TransportStart()
+	for i := 0; i < PPQN+1; i++ {
+		d.Tempo.ExternalTick()
+		time.Sleep(time.Minute / 100 / PPQN)
+	}
+	if bpm := d.Tempo.BPM(); bpm < 90 || bpm > 101 {
+		t.Errorf("a clock at 100 BPM gave %v BPM", bpm)
+	}
+	if !d.Tempo.External() || !d.Tempo.Playing() || !d.Tempo.Running() {
+		t.Error("not following the playing MIDI clock")
+	}
+	d.TransportStop()
+	if d.Tempo.Running() {
+		t.Error("running while the DAW is stopped")
+	}
+	// continuing from the song position of the second beat
+	d.Tempo.SetSongPosition(4)
+	d.TransportContinue()
+	for len(ticks) > 0 {
+		<-ticks
+	}
+	d.Tempo.ExternalTick()
+	if tick := <-ticks; tick != PPQN {
+		t.Errorf("continued at tick %d, want %d", tick, PPQN)
+	}
+}
+
+func TestMetronomeLED(t *testing.T) {
+	d := newTestDevice()
+	if err := d.SetTempoConfig(TempoConfig{MetronomeLED: NB_BUTTONS}); err == nil {
+		t.Error("metronome LED outside of the report accepted")
+	}
+	if err := d.SetTempoConfig(TempoConfig{MetronomeLED: M_BUTTON, MetronomeColor: Color{WHITE, 1}, AccentColor: Color{RED, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.DefaultButtonsBuffer[M_BUTTON] = GetColor(Color{BLUE, 1})
+	d.mu.Unlock()
+	led := func() byte {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.CurrentButtonsBuffer[M_BUTTON]
+	}
+	d.ToggleMetronome()
+	// the first beat of a bar
+	ticks := d.Tempo.Subscribe()
+	for tick := <-ticks; tick%(PPQN*4) != 0; {
+		tick = <-ticks
+	}
+	d.Tempo.Unsubscribe(ticks)
+	waitFor(t, func() bool { return led() == GetColor(Color{RED, 2}) }, "the accent color")
+	d.ToggleMetronome()
+	waitFor(t, func() bool { return led() == GetColor(Color{BLUE, 1}) }, "the default color once stopped")
+}
+
+// waitFor fails the test if cond doesn't become true within a second
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("never got", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRickRollRestoresTempo(t *testing.T) {
+	d := newTestDevice()
+	d.Tempo.SetBPM(90)
+	// without its MIDI file, the rickroll stops at once
+	rickRollAnimation(d, make(chan struct{}))
+	if bpm := d.Tempo.BPM(); bpm != 90 {
+		t.Errorf("tempo after the rickroll is %v, want 90", bpm)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+const (
+	PLAY_LED = 29
+	// guessed from the order of the transport buttons, like the octave LEDs; see ControlLEDs
+	LOOP_LED  = 26
+	METRO_LED = 27
+	TEMPO_LED = 28
+	REC_LED   = 30
+	STOP_LED  = 31
+)
+
+type SyncConfig struct {
+	// MIDI input to follow besides the keyboard's, by name substring, e.g. a loopback port the DAW sends its clock to
+	Input string `json:"input"`
+	// animation played while the DAW is playing
+	Animation string `json:"animation"`
+}
+
+var (
+	TransportBeatColor    = Color{GREEN, 2}
+	TransportPlayingColor = Color{GREEN, 0}
+	TransportStoppedColor = Color{WHITE, 0}
+)
+
+// TransportStart is called when the DAW starts playing from the beginning
+func (d *Device) TransportStart() {
+	d.Tempo.TransportStart()
+	d.followTransport(true)
+}
+
+// TransportContinue is called when the DAW resumes playing
+func (d *Device) TransportContinue() {
+	d.Tempo.TransportContinue()
+	d.followTransport(true)
+}
+
+func (d *Device) TransportStop() {
+	d.Tempo.TransportStop()
+	d.followTransport(false)
+}
+
+// followTransport shows whether the DAW is playing on the transport LEDs, and plays or stops the sync animation
+func (d *Device) followTransport(playing bool) {
+	midiLog.Info("transport", "playing", playing)
+	// with Mackie Control, the DAW lights the transport LEDs itself
+	if d.DAW.Mode == DAW_MCU && d.DAWOut != nil {
+		d.followTransportAnimation(playing)
+		return
+	}
+	stopLED, recLED := ledOf("StopPressed"), ledOf("RecPressed")
+	d.mu.Lock()
+	if d.stopTransport != nil {
+		close(d.stopTransport)
+		d.stopTransport = nil
+	}
+	if playing {
+		stop := make(chan struct{})
+		d.stopTransport = stop
+		go d.blinkTransport(stop)
+		d.CurrentButtonsBuffer[stopLED] = d.DefaultButtonsBuffer[stopLED]
+	} else {
+		d.CurrentButtonsBuffer[stopLED] = GetColor(TransportStoppedColor)
+		d.CurrentButtonsBuffer[recLED] = d.DefaultButtonsBuffer[recLED]
+	}
+	d.mu.Unlock()
+	d.MarkDirty(false, true)
+	d.followTransportAnimation(playing)
+}
+
+func (d *Device) followTransportAnimation(playing bool) {
+	animation := d.SyncConfig.Animation
+	if animation == "" {
+		return
+	}
+	if playing {
+		if err := d.StartAnimation(animation); err != nil {
+			animLog.Error("starting the sync animation", "err", err)
+		}
+	} else if d.CurrentAnimation() == animation {
+		d.StopAnimation()
+	}
+}
+
+// blinkTransport blinks the Play LED on the beats of the clock until stop is closed
+func (d *Device) blinkTransport(stop chan struct{}) {
+	led := ledOf("PlayPressed")
+	ticks := d.Tempo.Subscribe()
+	defer d.Tempo.Unsubscribe(ticks)
+	for {
+		var tick uint64
+		select {
+		case <-stop:
+			d.mu.Lock()
+			d.CurrentButtonsBuffer[led] = d.DefaultButtonsBuffer[led]
+			d.mu.Unlock()
+			d.MarkDirty(false, true)
+			return
+		case tick = <-ticks:
+		}
+		switch tick % PPQN {
+		case 0:
+			d.WriteButtonColor(led, GetColor(TransportBeatColor))
+		case PPQN / 4:
+			d.WriteButtonColor(led, GetColor(TransportPlayingColor))
+		}
+	}
+}
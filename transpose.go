@@ -0,0 +1,87 @@
+package main
+
+const (
+	MAX_OCTAVE_SHIFT   = 3
+	MAX_SEMITONE_SHIFT = 11
+	// LEDs of the octave buttons in the 0x80 report; not verified on the device, see ControlLEDs
+	OCTAVE_DOWN_LED = 40
+	OCTAVE_UP_LED   = 41
+)
+
+// litNote is a key lit by NoteOnCallback, kept so that NoteOffCallback and Transpose clear the right key
+type litNote struct {
+	key   int
+	color byte
+}
+
+// noteKey maps an incoming note to the physical key, undoing the keyboard's transposition. Called with d.mu held.
+func (d *Device) noteKey(note uint8) int {
+	return int(note) + OFFSET - d.octave*12 - d.semitone
+}
+
+// Transpose changes the transposition by the given number of octaves and semitones, following the keyboard.
+// Lit notes move with it; those that end up outside of the keyboard are cleared.
+func (d *Device) Transpose(octaves, semitones int) {
+	d.mu.Lock()
+	if d.learn != nil {
+		d.clearLearnStep()
+	}
+	d.octave = clamp(d.octave+octaves, -MAX_OCTAVE_SHIFT, MAX_OCTAVE_SHIFT)
+	d.semitone = clamp(d.semitone+semitones, -MAX_SEMITONE_SHIFT, MAX_SEMITONE_SHIFT)
+	d.renderScaleGuide()
+	if d.learn != nil {
+		d.checkLearnRange()
+		if d.learnStepDone() {
+			d.showLearnStep(d.nextLearnStep(d.learn.pos))
+		} else {
+			d.lightLearnStep()
+		}
+	}
+	for _, lit := range d.litNotes {
+		d.CurrentKeysBuffer[lit.key] = d.DefaultKeysBuffer[lit.key]
+	}
+	for note, lit := range d.litNotes {
+		key := d.noteKey(note)
+		if key < 0 || key >= NB_KEYS {
+			delete(d.litNotes, note)
+			continue
+		}
+		d.CurrentKeysBuffer[key] = lit.color
+		d.litNotes[note] = litNote{key, lit.color}
+	}
+	d.showTransposition()
+	d.mu.Unlock()
+	d.MarkDirty(true, true)
+	d.saveStateLater()
+}
+
+// Transposition returns the keyboard's transposition in octaves and semitones
+func (d *Device) Transposition() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.octave, d.semitone
+}
+
+// showTransposition lights the octave button in the direction of the transposition. Called with d.mu held.
+func (d *Device) showTransposition() {
+	down, up := GetColor(Color{BLACK, 0}), GetColor(Color{BLACK, 0})
+	if shift := d.octave*12 + d.semitone; shift < 0 {
+		down = GetColor(Color{WHITE, 2})
+	} else if shift > 0 {
+		up = GetColor(Color{WHITE, 2})
+	}
+	// the defaults too, so that restoring them doesn't hide the transposition
+	downLED, upLED := ledOf("OctaveDecreasePressed"), ledOf("OctaveIncreasePressed")
+	d.CurrentButtonsBuffer[downLED], d.DefaultButtonsBuffer[downLED] = down, down
+	d.CurrentButtonsBuffer[upLED], d.DefaultButtonsBuffer[upLED] = up, up
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
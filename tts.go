@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type TTSConfig struct {
+	// "tts.speak" (default), "piper", "cloud" or "google_translate"
+	Engine string `json:"engine"`
+	// TTS entity used by tts.speak, e.g. "tts.home_assistant_cloud"; "piper" defaults to "tts.piper"
+	Entity      string `json:"entity"`
+	MediaPlayer string `json:"media_player"`
+	// text/template with .Scene, .Animation and .State, e.g. "Scene {{.Scene}}"
+	Message  string `json:"message"`
+	Language string `json:"language"`
+	// volume_level to speak at, restored after the playback; 0 keeps the current volume
+	Volume float64 `json:"volume"`
+}
+
+type ttsTemplateData struct {
+	Scene     string
+	Animation string
+	State     DeviceState
+}
+
+func (c *TTSConfig) Action() Action {
+	message, err := template.New("tts").Parse(c.Message)
+	return func(d *Device) error {
+		if err != nil {
+			return err
+		}
+		var text strings.Builder
+		err := message.Execute(&text, ttsTemplateData{Scene: d.CurrentScene(), Animation: d.CurrentAnimation(), State: d.GetState()})
+		if err != nil {
+			return err
+		}
+		return d.HA.Speak(*c, text.String())
+	}
+}
+
+type EntityState struct {
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (ha *HomeAssistant) GetState(entity string) (*EntityState, error) {
+	body, err := ha.CallHomeAssistant("states/"+entity, "GET", "")
+	if err != nil {
+		return nil, err
+	}
+	var state EntityState
+	if err := json.Unmarshal([]byte(body), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (ha *HomeAssistant) setVolume(entity string, volume float64) error {
+	return ha.CallService("media_player.volume_set", map[string]interface{}{"entity_id": entity, "volume_level": volume})
+}
+
+// Speak says message on the media player. If a volume is set, the previous volume is restored in the background once the player stops playing.
+func (ha *HomeAssistant) Speak(c TTSConfig, message string) error {
+	previousVolume := -1.0
+	if c.Volume > 0 {
+		state, err := ha.GetState(c.MediaPlayer)
+		if err != nil {
+			return err
+		}
+		// volume_level is missing while the player is off
+		if v, ok := state.Attributes["volume_level"].(float64); ok {
+			previousVolume = v
+		}
+		if err := ha.setVolume(c.MediaPlayer, c.Volume); err != nil {
+			return err
+		}
+	}
+	var service string
+	data := map[string]interface{}{"message": message}
+	if c.Language != "" {
+		data["language"] = c.Language
+	}
+	switch c.Engine {
+	case "", "tts.speak", "piper":
+		service = "tts.speak"
+		entity := c.Entity
+		if entity == "" && c.Engine == "piper" {
+			entity = "tts.piper"
+		}
+		data["entity_id"] = entity
+		data["media_player_entity_id"] = c.MediaPlayer
+	case "cloud":
+		service = "tts.cloud_say"
+		data["entity_id"] = c.MediaPlayer
+	case "google_translate":
+		service = "tts.google_translate_say"
+		data["entity_id"] = c.MediaPlayer
+	default:
+		return fmt.Errorf("unknown TTS engine %q", c.Engine)
+	}
+	err := ha.CallService(service, data)
+	if previousVolume >= 0 {
+		go func() {
+			ha.waitForPlayback(c.MediaPlayer)
+			if err := ha.setVolume(c.MediaPlayer, previousVolume); err != nil {
+				haLog.Error("restoring the volume", "media_player", c.MediaPlayer, "err", err)
+			}
+		}()
+	}
+	return err
+}
+
+// waitForPlayback waits for the player to start and then to stop playing, giving up after a while on either
+func (ha *HomeAssistant) waitForPlayback(entity string) {
+	playing := func() bool {
+		state, err := ha.GetState(entity)
+		return err == nil && state.State == "playing"
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !playing() && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	deadline = time.Now().Add(5 * time.Minute)
+	for playing() && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpeakRestoresVolume(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	spoken, statesAfter := false, 0
+	restored := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/api/")
+		if strings.HasPrefix(path, "states/") {
+			// idle before the announcement, then playing once and idle again
+			state := "idle"
+			if spoken {
+				statesAfter++
+				if statesAfter == 1 {
+					state = "playing"
+				}
+			}
+			// the polls while waiting for the playback are recorded once
+			if len(calls) == 0 || !strings.HasPrefix(calls[len(calls)-1], "states/") {
+				calls = append(calls, path)
+			}
+			fmt.Fprintf(w, `{"state": %q, "attributes": {"volume_level": 0.3}}`, state)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var data map[string]interface{}
+		json.Unmarshal(body, &data)
+		switch path {
+		case "services/media_player/volume_set":
+			calls = append(calls, fmt.Sprintf("volume_set %v", data["volume_level"]))
+			if spoken {
+				close(restored)
+			}
+		case "services/tts/speak":
+			calls = append(calls, "tts.speak "+data["message"].(string))
+			spoken = true
+		default:
+			calls = append(calls, path)
+		}
+		fmt.Fprint(w, "[]")
+	}))
+	defer srv.Close()
+
+	ha := &HomeAssistant{URL: srv.URL + "/api/"}
+	c := TTSConfig{Entity: "tts.test", MediaPlayer: "media_player.kitchen", Message: "hello", Volume: 0.8}
+	if err := ha.Speak(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-restored:
+	case <-time.After(5 * time.Second):
+		t.Fatal("volume not restored")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"states/media_player.kitchen",
+		"volume_set 0.8",
+		"tts.speak hello",
+		"states/media_player.kitchen",
+		"volume_set 0.3",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}